@@ -1,30 +1,37 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/appservR/appservR/models"
 	"github.com/appservR/appservR/modules/appserver"
 	"github.com/appservR/appservR/modules/appsource"
 	"github.com/appservR/appservR/modules/config"
+	"github.com/appservR/appservR/modules/rinstall"
 	"github.com/gin-gonic/gin"
 )
 
 type AppController struct {
-	appModel  models.AppModel
-	appServer *appserver.AppServer
-	config    config.Config
+	appModel        models.AppModel
+	deploymentModel models.DeploymentModel
+	appServer       *appserver.AppServer
+	config          config.Config
 }
 
 // Create a new controller object
-func NewAppController(appModel models.AppModel, appServer *appserver.AppServer, config config.Config) *AppController {
+func NewAppController(appModel models.AppModel, deploymentModel models.DeploymentModel,
+	appServer *appserver.AppServer, config config.Config) *AppController {
 	return &AppController{
-		appModel:  appModel,
-		appServer: appServer,
-		config:    config,
+		appModel:        appModel,
+		deploymentModel: deploymentModel,
+		appServer:       appServer,
+		config:          config,
 	}
 }
 
@@ -64,14 +71,56 @@ func (ctl *AppController) GetApp() gin.HandlerFunc {
 
 // Form bindings for apps settings
 type AppSettings struct {
-	Name           string   `form:"appname" binding:"required"`
-	Path           string   `form:"path" binding:"required"`
-	Properties     []string `form:"properties[]"`
-	RestrictAccess int      `form:"restrictaccess"`
-	AllowedGroups  []string `form:"allowedgroups"`
-	AppSource      string   `form:"appsource"`
-	AppDir         string   `form:"appdir"`
-	Workers        int      `form:"workers"`
+	Name              string   `form:"appname" binding:"required"`
+	Path              string   `form:"path" binding:"required"`
+	Hostnames         string   `form:"hostnames"`
+	Properties        []string `form:"properties[]"`
+	RestrictAccess    int      `form:"restrictaccess"`
+	AllowedGroups     []string `form:"allowedgroups"`
+	AppSource         string   `form:"appsource"`
+	AppDir            string   `form:"appdir"`
+	GitSourceUrl      string   `form:"gitsourceurl"`
+	GitSourceBranch   string   `form:"gitsourcebranch"`
+	GitSourceToken    string   `form:"gitsourcetoken"`
+	UpstreamUrl       string   `form:"upstreamurl"`
+	Runtime           string   `form:"runtime"`
+	RInstallation     string   `form:"rinstallation"`
+	Command           string   `form:"command"`
+	MinWorkers        int      `form:"minworkers"`
+	MaxWorkers        int      `form:"maxworkers"`
+	UsersPerWorker    int      `form:"usersperworker"`
+	MaxUsersPerWorker int      `form:"maxusersperworker"`
+	MaxDrainTime      int      `form:"maxdraintime"`
+	Strategy          string   `form:"strategy"`
+	MemoryLimit       int      `form:"memorylimit"`
+	CPULimit          int      `form:"cpulimit"`
+	OpenFilesLimit    int      `form:"openfileslimit"`
+	WallTimeLimit     int      `form:"walltimelimit"`
+	RunAsUser         string   `form:"runasuser"`
+	RunAsGroup        string   `form:"runasgroup"`
+	EnvNames          []string `form:"envnames[]"`
+	EnvValues         []string `form:"envvalues[]"`
+	EnvSecrets        []string `form:"envsecrets[]"`
+}
+
+// Get the environment variables from the app settings form, skipping rows without a name
+func (s AppSettings) envVars() []models.AppEnvVar {
+	envVars := []models.AppEnvVar{}
+	for i, name := range s.EnvNames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		v := models.AppEnvVar{Name: name}
+		if i < len(s.EnvValues) {
+			v.Value = s.EnvValues[i]
+		}
+		if i < len(s.EnvSecrets) {
+			v.Secret = s.EnvSecrets[i] == "1"
+		}
+		envVars = append(envVars, v)
+	}
+	return envVars
 }
 
 // Update or create an app
@@ -84,9 +133,12 @@ func (ctl *AppController) UpdateApp() gin.HandlerFunc {
 		err := c.ShouldBind(&appInfo)
 		if err == nil && appname != "" {
 			isActive := false
+			watchChanges := false
 			for _, val := range appInfo.Properties {
 				if val == "active" {
 					isActive = true
+				} else if val == "watch" {
+					watchChanges = true
 				}
 			}
 			groups := make([]models.Group, len(appInfo.AllowedGroups))
@@ -94,21 +146,70 @@ func (ctl *AppController) UpdateApp() gin.HandlerFunc {
 				groups[i] = models.Group{Name: appInfo.AllowedGroups[i]}
 			}
 			app := models.App{
-				Name:           appInfo.Name,
-				Path:           appInfo.Path,
-				AppSource:      appInfo.AppSource,
-				AppDir:         appInfo.AppDir,
-				Workers:        appInfo.Workers,
-				IsActive:       isActive,
-				RestrictAccess: appInfo.RestrictAccess,
-				AllowedGroups:  groups,
+				Name:              appInfo.Name,
+				Path:              appInfo.Path,
+				Hostnames:         appInfo.Hostnames,
+				AppSource:         appInfo.AppSource,
+				AppDir:            appInfo.AppDir,
+				GitSourceUrl:      appInfo.GitSourceUrl,
+				GitSourceBranch:   appInfo.GitSourceBranch,
+				GitSourceToken:    appInfo.GitSourceToken,
+				UpstreamUrl:       strings.TrimSpace(appInfo.UpstreamUrl),
+				Runtime:           appInfo.Runtime,
+				RInstallation:     appInfo.RInstallation,
+				Command:           appInfo.Command,
+				WatchChanges:      watchChanges,
+				MinWorkers:        appInfo.MinWorkers,
+				MaxWorkers:        appInfo.MaxWorkers,
+				UsersPerWorker:    appInfo.UsersPerWorker,
+				MaxUsersPerWorker: appInfo.MaxUsersPerWorker,
+				MaxDrainTime:      appInfo.MaxDrainTime,
+				Strategy:          appInfo.Strategy,
+				MemoryLimit:       appInfo.MemoryLimit,
+				CPULimit:          appInfo.CPULimit,
+				OpenFilesLimit:    appInfo.OpenFilesLimit,
+				WallTimeLimit:     appInfo.WallTimeLimit,
+				RunAsUser:         strings.TrimSpace(appInfo.RunAsUser),
+				RunAsGroup:        strings.TrimSpace(appInfo.RunAsGroup),
+				IsActive:          isActive,
+				RestrictAccess:    appInfo.RestrictAccess,
+				AllowedGroups:     groups,
+				EnvVars:           appInfo.envVars(),
+			}
+			prevApp, _ := ctl.appModel.Find(appname)
+			// the stored token is not sent to the form, and is kept if no new token is provided,
+			// unless it would be sent to another repository
+			if app.GitSourceToken == "" && app.GitSourceUrl == prevApp.GitSourceUrl {
+				app.GitSourceToken = prevApp.GitSourceToken
+			}
+			// a revision pinned by a rollback is kept until the app source changes
+			if !sourceChanged(prevApp, app) {
+				app.GitRevision = prevApp.GitRevision
 			}
 			appSource := appsource.NewAppSource(app, ctl.config, true)
 			err = appSource.Error()
+			if err == nil {
+				_, err = rinstall.Path(ctl.config, app.RInstallation)
+			}
+			if err == nil {
+				err = appserver.CheckRunAs(app.RunAsUser, app.RunAsGroup)
+			}
+			if err == nil {
+				err = appserver.CheckStrategy(app.Strategy)
+			}
 			if err == nil {
 				err = ctl.appModel.Save(app, appname)
 				if err == nil {
+					// reload the app to get the actual values of masked secrets
+					if saved, err := ctl.appModel.Find(app.Name); err == nil {
+						app = saved
+					}
 					ctl.appServer.Update(appname, app)
+					if appname == "new" || sourceChanged(prevApp, app) {
+						if err := ctl.recordDeployment(c, app); err != nil {
+							ctl.config.Logger().Info(err.Error())
+						}
+					}
 					res, err = ctl.buildAppTemplateData(app, c)
 					res["successMessage"] = "App updated successfuly."
 					c.HTML(http.StatusOK, "app.html", res)
@@ -122,9 +223,15 @@ func (ctl *AppController) UpdateApp() gin.HandlerFunc {
 		for i := 0; i < v.NumField(); i++ {
 			res[t.Field(i).Name] = v.Field(i).Interface()
 		}
+		delete(res, "GitSourceToken")
+		if stored, err := ctl.appModel.Find(appname); err == nil {
+			res["HasGitSourceToken"] = stored.GitSourceToken != ""
+		}
+		res["EnvVars"] = models.EnvVarsAsMapSlice(appInfo.envVars())
 		res = gin.H{"AppSettings": res}
 		res["selTab"] = "apps"
 		res["loggedUserName"] = GetLoggedName(c)
+		res["RInstallations"] = rinstall.List(ctl.config)
 		res["errorMessage"] = "App update failed. Please check the info provided."
 		logger := ctl.config.Logger()
 		logger.Info(err.Error())
@@ -134,13 +241,274 @@ func (ctl *AppController) UpdateApp() gin.HandlerFunc {
 	}
 }
 
+// Restart all instances of an app
+func (ctl *AppController) RestartApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		err := ctl.appServer.Restart(appName)
+		ctl.renderAppResult(c, appName, err, "App is restarting.")
+	}
+}
+
+// Get a controller function applying an action (restart, phaseout or kill) to an app instance
+func (ctl *AppController) InstanceAction(action string, successMessage string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		err := ctl.appServer.InstanceAction(appName, c.Param("instid"), action)
+		ctl.renderAppResult(c, appName, err, successMessage)
+	}
+}
+
+// Get the details of the instances of an app as json
+func (ctl *AppController) GetInstances() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := ctl.appServer.GetStatus(c.Param("appname"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, status["Instances"])
+	}
+}
+
+// Restart the instances of an app which failed because of repeated crashes
+func (ctl *AppController) RetryApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		err := ctl.appServer.Retry(appName)
+		ctl.renderAppResult(c, appName, err, "Failed instances have been restarted.")
+	}
+}
+
+// Fetch the latest version of an app from its source and restart it
+func (ctl *AppController) RedeployApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		app, err := ctl.appModel.Find(appName)
+		if err == nil {
+			err = ctl.appServer.Redeploy(appName)
+		}
+		if err == nil && app.GitRevision != "" {
+			app.GitRevision = ""
+			err = ctl.appModel.Save(app, appName)
+		}
+		if err == nil {
+			err = ctl.recordDeployment(c, app)
+		}
+		ctl.renderAppResult(c, appName, err, "App has been redeployed.")
+	}
+}
+
+// Upload a zip or tar.gz bundle and switch the app to it
+func (ctl *AppController) UploadBundle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		app, err := ctl.appModel.Find(appName)
+		if err == nil {
+			err = ctl.deployBundle(c, app)
+		}
+		ctl.renderAppResult(c, appName, err, "App bundle has been deployed.")
+	}
+}
+
+// Extract the uploaded bundle and save it as the new app source
+func (ctl *AppController) deployBundle(c *gin.Context, app models.App) error {
+	// the request body is capped so that larger uploads are not buffered to disk
+	if maxSize := int64(ctl.config.GetInt("deployments.maxsize")) << 20; maxSize > 0 {
+		if c.Request.ContentLength > maxSize+1<<20 {
+			return fmt.Errorf("bundle is larger than %d MB", maxSize>>20)
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1<<20)
+	}
+	fileHeader, err := c.FormFile("bundle")
+	if err != nil {
+		return errors.New("no bundle file provided, or bundle too large")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return errors.New("unable to read bundle file")
+	}
+	defer file.Close()
+	dir, err := appsource.ExtractBundle(app, ctl.config, file, fileHeader.Size, fileHeader.Filename)
+	if err != nil {
+		return err
+	}
+	appName := app.Name
+	app.AppSource = "bundle"
+	app.AppDir = dir
+	app.GitRevision = ""
+	err = ctl.appModel.Save(app, appName)
+	if err != nil {
+		return err
+	}
+	err = ctl.appServer.Update(appName, app)
+	if err != nil {
+		return err
+	}
+	return ctl.recordDeployment(c, app)
+}
+
+// Switch an app back to a previous deployment
+func (ctl *AppController) RollbackApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appName := c.Param("appname")
+		err := ctl.rollback(c, appName, c.Param("deployment"))
+		ctl.renderAppResult(c, appName, err, "App has been rolled back.")
+	}
+}
+
+// Restore the app source of a deployment
+func (ctl *AppController) rollback(c *gin.Context, appName string, deploymentID string) error {
+	id, err := strconv.ParseUint(deploymentID, 10, 64)
+	if err != nil {
+		return errors.New("invalid deployment id")
+	}
+	deployment, err := ctl.deploymentModel.Find(appName, uint(id))
+	if err != nil {
+		return err
+	}
+	app, err := ctl.appModel.Find(appName)
+	if err != nil {
+		return err
+	}
+	if deployment.AppSource == "git" {
+		if app.AppSource != "git" || app.GitSourceUrl != deployment.SourcePath {
+			return errors.New("the app is no longer deployed from this git repository")
+		}
+		err = ctl.appServer.Checkout(appName, deployment.Revision)
+		if err == nil {
+			// the revision is checked out again when the app restarts
+			app.GitRevision = deployment.Revision
+			err = ctl.appModel.Save(app, appName)
+		}
+	} else {
+		app.AppSource = deployment.AppSource
+		app.GitRevision = ""
+		if deployment.AppSource == "external" {
+			app.UpstreamUrl = deployment.SourcePath
+		} else {
+			app.AppDir = deployment.SourcePath
+		}
+		err = appsource.NewAppSource(app, ctl.config, true).Error()
+		if err == nil {
+			err = ctl.appModel.Save(app, appName)
+		}
+		if err == nil {
+			err = ctl.appServer.Update(appName, app)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return ctl.recordDeployment(c, app)
+}
+
+// Check whether app settings changes require a new deployment
+func sourceChanged(prevApp models.App, app models.App) bool {
+	return prevApp.AppSource != app.AppSource || prevApp.AppDir != app.AppDir ||
+		prevApp.GitSourceUrl != app.GitSourceUrl || prevApp.GitSourceBranch != app.GitSourceBranch ||
+		prevApp.UpstreamUrl != app.UpstreamUrl
+}
+
+// Add the current app source to the deployment history and delete old bundles
+func (ctl *AppController) recordDeployment(c *gin.Context, app models.App) error {
+	revision, err := ctl.appServer.Revision(app.Name)
+	if err != nil {
+		return err
+	}
+	deployment := models.Deployment{
+		Revision:   revision,
+		AppSource:  app.AppSource,
+		SourcePath: app.AppDir,
+		DeployedBy: c.GetString("username"),
+	}
+	if app.AppSource == "git" {
+		deployment.SourcePath = app.GitSourceUrl
+	} else if app.AppSource == "external" {
+		deployment.SourcePath = app.UpstreamUrl
+	}
+	err = ctl.deploymentModel.Record(app.Name, deployment)
+	if err != nil {
+		return err
+	}
+	deployments, err := ctl.deploymentModel.ForApp(app.Name)
+	if err != nil {
+		return err
+	}
+	keep := []string{}
+	for _, d := range deployments {
+		if d.AppSource == "bundle" && len(keep) < ctl.config.GetInt("deployments.keep") {
+			keep = append(keep, d.SourcePath)
+		}
+	}
+	return appsource.PruneBundles(app, ctl.config, keep)
+}
+
+// Render the app details page after an action, with an error or success message
+func (ctl *AppController) renderAppResult(c *gin.Context, appName string, actionErr error, successMessage string) {
+	app, err := ctl.appModel.Find(appName)
+	var res gin.H
+	if err == nil {
+		res, err = ctl.buildAppTemplateData(app, c)
+	}
+	if err != nil {
+		res = ctl.buildAppsTemplateData(c)
+		res["errorMessage"] = fmt.Sprintf("Could not find app %s.", appName)
+		c.HTML(http.StatusNotFound, "apps.html", res)
+		c.Abort()
+		return
+	}
+	if actionErr != nil {
+		ctl.config.Logger().Info(actionErr.Error())
+		res["errorMessage"] = "Action failed: " + actionErr.Error()
+		c.HTML(http.StatusBadRequest, "app.html", res)
+		c.Abort()
+		return
+	}
+	res["successMessage"] = successMessage
+	c.HTML(http.StatusOK, "app.html", res)
+}
+
+// Stream the console output of an app instance as server-sent events
+func (ctl *AppController) TailInstanceLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log, err := ctl.appServer.InstanceLog(c.Param("appname"), c.Param("instid"))
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+
+		buffered, lines := log.Follow()
+		defer log.Unsubscribe(lines)
+		for _, line := range buffered {
+			c.SSEvent("message", line)
+		}
+		c.Writer.Flush()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case line := <-lines:
+				c.SSEvent("message", line)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
+
 // Controller function to delete a R app
 func (ctl *AppController) DeleteApp() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		appName := c.Param("appname")
+		ctl.appServer.Delete(appName)
 		err := ctl.appModel.Delete(appName)
+		if err == nil {
+			err = appsource.DeleteBundles(models.App{Name: appName}, ctl.config)
+		}
 		res := ctl.buildAppsTemplateData(c)
-		ctl.appServer.Update(appName, models.App{})
 		if err != nil {
 			res["errorMessage"] = fmt.Sprintf("An error occured while deleting app %s.", appName)
 			c.HTML(http.StatusOK, "apps.html", res)
@@ -163,6 +531,7 @@ func (ctl *AppController) buildAppTemplateData(app models.App, c *gin.Context) (
 		"selTab":         "apps",
 		"Title":          strings.Title(app.Name),
 		"AppSettings":    appMap,
+		"RInstallations": rinstall.List(ctl.config),
 	}
 	if app.Name != "" {
 		status, err := ctl.appServer.GetStatus(app.Name)
@@ -170,6 +539,11 @@ func (ctl *AppController) buildAppTemplateData(app models.App, c *gin.Context) (
 			return nil, err
 		}
 		data["Status"] = status
+		deployments, err := ctl.deploymentModel.ForApp(app.Name)
+		if err != nil {
+			return nil, err
+		}
+		data["Deployments"] = ctl.deploymentModel.AsMapSlice(deployments)
 	}
 	return data, nil
 }
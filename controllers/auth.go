@@ -3,10 +3,12 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/appservR/appservR/models"
 	"github.com/appservR/appservR/modules/auth"
+	"github.com/appservR/appservR/modules/config"
 	"github.com/gin-gonic/gin"
 )
 
@@ -21,14 +23,31 @@ func GetLoggedName(c *gin.Context) string {
 
 type AuthController struct {
 	userModel models.UserModel
+	config    config.Config
 }
 
-func NewAuthController(userModel models.UserModel) *AuthController {
+func NewAuthController(userModel models.UserModel, config config.Config) *AuthController {
 	return &AuthController{
 		userModel: userModel,
+		config:    config,
 	}
 }
 
+// Get the path of the auth cookie, which is valid for the whole server
+func (ctl *AuthController) cookiePath() string {
+	return config.BaseURL(ctl.config) + "/"
+}
+
+// Check that a redirect target is a path on this server; browsers read backslashes as
+// slashes, so "/\host" would lead to another host like "//host"
+func localRedirect(ref string) bool {
+	if !strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "//") || strings.Contains(ref, "\\") {
+		return false
+	}
+	u, err := url.Parse(ref)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
 type loginCredentials struct {
 	Username string `form:"username"`
 	Password string `form:"password"`
@@ -53,13 +72,15 @@ func (ctl *AuthController) DoLogin() gin.HandlerFunc {
 			cookie := http.Cookie{
 				Name:     "token",
 				Value:    token,
-				Path:     "/",
+				Path:     ctl.cookiePath(),
 				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				Secure:   c.GetString("scheme") == "https",
 			}
 			http.SetCookie(c.Writer, &cookie)
 			ref := credentials.Referer
-			if strings.HasSuffix(ref, "/auth/signup") {
-				ref = "/"
+			if !localRedirect(ref) || strings.HasSuffix(ref, "/auth/signup") {
+				ref = config.BaseURL(ctl.config) + "/"
 			}
 			c.Redirect(http.StatusFound, ref)
 		} else {
@@ -77,10 +98,10 @@ func (ctl *AuthController) DoLogout() gin.HandlerFunc {
 		cookie := http.Cookie{
 			Name:  "token",
 			Value: "",
-			Path:  "/",
+			Path:  ctl.cookiePath(),
 		}
 		http.SetCookie(c.Writer, &cookie)
-		c.Redirect(http.StatusFound, "/")
+		c.Redirect(http.StatusFound, config.BaseURL(ctl.config)+"/")
 	}
 }
 
@@ -4,12 +4,17 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"fmt"
 
 	"runtime/debug"
 
 	"github.com/appservR/appservR/modules/config"
+	"github.com/appservR/appservR/server"
 	"github.com/kardianos/service"
 	"github.com/spf13/cobra"
 )
@@ -21,27 +26,47 @@ var (
 	logger  service.Logger
 )
 
-func startApp() {
-	server, err := InitializeServer(config.RunFlags{Address: address, Mode: mode, Port: port})
-	if err != nil {
-		panic(err)
-	}
-	server.Start()
+type program struct {
+	sync.Mutex
+	server *server.AppRouter
 }
 
-type program struct{}
-
 func (p *program) Start(s service.Service) error {
 	go p.run()
 	return nil
 }
 
 func (p *program) run() {
-	startApp()
+	server, err := InitializeServer(config.RunFlags{Address: address, Mode: mode, Port: port})
+	if err != nil {
+		panic(err)
+	}
+	p.Lock()
+	p.server = server
+	p.Unlock()
+	err = server.Start()
+	if err != nil {
+		logger.Error(err)
+	}
 }
 
+// Shut down the server gracefully, stopping all app instances
 func (p *program) Stop(s service.Service) error {
-	return nil
+	p.Lock()
+	defer p.Unlock()
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Shutdown()
+}
+
+// Run the server in the foreground until SIGINT or SIGTERM is received
+func (p *program) serve() {
+	go p.run()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	p.Stop(nil)
 }
 
 func main() {
@@ -85,7 +110,7 @@ func main() {
 		Short: "Start server",
 		Long:  `Start server`,
 		Run: func(cmd *cobra.Command, args []string) {
-			startApp()
+			prg.serve()
 		},
 	}
 	cmdServe.Flags().StringVarP(&address, "address", "a", "", "server hostname or ip adress (default \"localhost\")")
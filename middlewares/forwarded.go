@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resolve the scheme and host used by the client, from the X-Forwarded-Proto and
+// X-Forwarded-Host headers when the request comes from a trusted proxy; these headers
+// are removed from requests of untrusted origin so that they are not passed on to apps
+func Forwarded() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		host := c.Request.Host
+		if _, trusted := c.RemoteIP(); trusted {
+			if proto := firstValue(c.GetHeader("X-Forwarded-Proto")); proto != "" {
+				scheme = strings.ToLower(proto)
+			}
+			if h := firstValue(c.GetHeader("X-Forwarded-Host")); h != "" {
+				host = h
+			}
+		} else {
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Prefix"} {
+				c.Request.Header.Del(h)
+			}
+		}
+		c.Set("scheme", scheme)
+		c.Set("host", host)
+	}
+}
+
+// Get the value set by the proxy closest to the client in a header which may hold a list
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
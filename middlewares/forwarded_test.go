@@ -0,0 +1,72 @@
+package middlewares
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestForwarded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.SetTrustedProxies([]string{"10.0.0.1"})
+	router.Use(Forwarded())
+	var scheme, host string
+	var header map[string]string
+	router.GET("/", func(c *gin.Context) {
+		scheme = c.GetString("scheme")
+		host = c.GetString("host")
+		header = map[string]string{}
+		for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Prefix"} {
+			header[h] = c.Request.Header.Get(h)
+		}
+	})
+	forwarded := map[string]string{
+		"X-Forwarded-For":    "192.0.2.1, 10.0.0.2",
+		"X-Forwarded-Proto":  "HTTPS, http",
+		"X-Forwarded-Host":   "public.example.org, proxy.local",
+		"X-Forwarded-Prefix": "/apps",
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		tls        bool
+		scheme     string
+		host       string
+		kept       bool
+	}{
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", headers: forwarded, scheme: "https", host: "public.example.org", kept: true},
+		{name: "untrusted client", remoteAddr: "192.0.2.1:1234", headers: forwarded, scheme: "http", host: "internal:8080"},
+		{name: "untrusted client over TLS", remoteAddr: "192.0.2.1:1234", headers: forwarded, tls: true, scheme: "https", host: "internal:8080"},
+		{name: "trusted proxy without headers", remoteAddr: "10.0.0.1:1234", scheme: "http", host: "internal:8080", kept: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = "internal:8080"
+			req.RemoteAddr = test.remoteAddr
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for h, v := range test.headers {
+				req.Header.Set(h, v)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			if scheme != test.scheme || host != test.host {
+				t.Errorf("expected %s://%s, got %s://%s", test.scheme, test.host, scheme, host)
+			}
+			for h, v := range header {
+				if test.kept && v != test.headers[h] {
+					t.Errorf("expected %s to be passed on from a trusted proxy, got %q", h, v)
+				}
+				if !test.kept && v != "" {
+					t.Errorf("expected %s to be removed from an untrusted request, got %q", h, v)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package models
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/appservR/appservR/modules/config"
 	"gorm.io/gorm"
@@ -11,17 +13,36 @@ import (
 
 type App struct {
 	gorm.Model
-	Name            string `gorm:"unique"`
-	Path            string
-	AppSource       string
-	AppDir          string
-	GitSourceUrl    string
-	GitSourceBranch string
-	GitSourceToken  string
-	Workers         int
-	IsActive        bool
-	RestrictAccess  int
-	AllowedGroups   []Group `gorm:"many2many:app_allowed_groups;"`
+	Name              string `gorm:"unique"`
+	Path              string
+	Hostnames         string
+	AppSource         string
+	AppDir            string
+	Runtime           string
+	Command           string
+	RInstallation     string
+	WatchChanges      bool
+	GitSourceUrl      string
+	GitSourceBranch   string
+	GitSourceToken    string
+	GitRevision       string // revision pinned by a rollback, instead of the latest one
+	UpstreamUrl       string
+	MinWorkers        int `gorm:"column:workers"`
+	MaxWorkers        int
+	UsersPerWorker    int
+	MaxUsersPerWorker int
+	MaxDrainTime      int
+	Strategy          string
+	MemoryLimit       int // MB
+	CPULimit          int // percentage of one core
+	OpenFilesLimit    int
+	WallTimeLimit     int // minutes
+	RunAsUser         string
+	RunAsGroup        string
+	IsActive          bool
+	RestrictAccess    int
+	AllowedGroups     []Group `gorm:"many2many:app_allowed_groups;"`
+	EnvVars           []AppEnvVar
 }
 
 type AppModel interface {
@@ -36,26 +57,34 @@ type AppModel interface {
 type AppModelDB struct {
 	DB         *gorm.DB
 	groupModel *GroupModelDB
+	secrets    cipher.AEAD
 }
 
-func NewAppModelDB(db *gorm.DB, groupModel *GroupModelDB) (*AppModelDB, error) {
+func NewAppModelDB(db *gorm.DB, groupModel *GroupModelDB, conf config.Config) (*AppModelDB, error) {
+
+	secrets, err := newSecretCipher(conf)
+	if err != nil {
+		return nil, err
+	}
 
 	appModel := AppModelDB{
 		DB:         db,
 		groupModel: groupModel,
+		secrets:    secrets,
 	}
 
 	app := App{}
 
-	err := db.First(&app).Error
+	err = db.First(&app).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			defaultApp := App{
 				Name:           "sample-app",
 				Path:           "/",
 				AppSource:      "sample-app",
+				Runtime:        "shiny",
 				AppDir:         "apps/sample-app/",
-				Workers:        2,
+				MinWorkers:     2,
 				IsActive:       true,
 				RestrictAccess: config.AccessLevels.PUBLIC,
 			}
@@ -70,13 +99,27 @@ func NewAppModelDB(db *gorm.DB, groupModel *GroupModelDB) (*AppModelDB, error) {
 	return &appModel, nil
 }
 
+// Check that an app name can be used in file paths, as it names the app sources and logs folders
+func CheckAppName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid app name %q: it cannot be empty or contain '/', '\\' or '..'", name)
+	}
+	return nil
+}
+
 // Get all apps
 func (m *AppModelDB) All() ([]App, error) {
 	var apps []App
-	err := m.DB.Preload("AllowedGroups").Find(&apps).Error
+	err := m.DB.Preload("AllowedGroups").Preload("EnvVars").Find(&apps).Error
 	if err != nil {
 		return []App{}, errors.New("unable to retrieve apps")
 	}
+	for i := range apps {
+		err = m.decryptEnvVars(&apps[i])
+		if err != nil {
+			return []App{}, err
+		}
+	}
 	return apps, nil
 }
 
@@ -91,6 +134,10 @@ func (m *AppModelDB) Find(name string) (App, error) {
 			return App{}, fmt.Errorf("app %s does not exist", name)
 		}
 	}
+	err = m.decryptEnvVars(&app)
+	if err != nil {
+		return App{}, err
+	}
 	return app, nil
 }
 
@@ -110,9 +157,26 @@ func (m *AppModelDB) Save(app App, oldName string) error {
 	if app.Name == "new" {
 		return errors.New("app name cannot be 'new'")
 	}
+	err = CheckAppName(app.Name)
+	if err != nil {
+		return err
+	}
+
+	app.Hostnames, err = normalizeHostnames(app)
+	if err != nil {
+		return err
+	}
+	err = m.checkRouting(app, oldName)
+	if err != nil {
+		return err
+	}
 
 	if oldName == "new" {
-		err := m.DB.Create(&app).Error
+		app.EnvVars, err = m.encryptEnvVars(app.EnvVars, nil)
+		if err != nil {
+			return err
+		}
+		err = m.DB.Create(&app).Error
 		if err != nil {
 			return errors.New("failed to create new app")
 		}
@@ -121,20 +185,43 @@ func (m *AppModelDB) Save(app App, oldName string) error {
 
 	var currentApp App
 
-	err = m.DB.First(&currentApp, "name=?", oldName).Error
+	err = m.DB.Preload("EnvVars").First(&currentApp, "name=?", oldName).Error
 	if err != nil {
 		return fmt.Errorf("update failed; could not find app: %s", oldName)
 	}
+	envVars, err := m.encryptEnvVars(app.EnvVars, currentApp.EnvVars)
+	if err != nil {
+		return err
+	}
 	updateMap := map[string]interface{}{
-		"Name":            app.Name,
-		"Path":            app.Path,
-		"AppDir":          app.AppDir,
-		"GitSourceUrl":    app.GitSourceUrl,
-		"GitSourceBranch": app.GitSourceBranch,
-		"GitSourceToken":  app.GitSourceToken,
-		"Workers":         app.Workers,
-		"IsActive":        app.IsActive,
-		"RestrictAccess":  app.RestrictAccess,
+		"Name":              app.Name,
+		"Path":              app.Path,
+		"Hostnames":         app.Hostnames,
+		"AppSource":         app.AppSource,
+		"AppDir":            app.AppDir,
+		"Runtime":           app.Runtime,
+		"Command":           app.Command,
+		"RInstallation":     app.RInstallation,
+		"WatchChanges":      app.WatchChanges,
+		"GitSourceUrl":      app.GitSourceUrl,
+		"GitSourceBranch":   app.GitSourceBranch,
+		"GitSourceToken":    app.GitSourceToken,
+		"GitRevision":       app.GitRevision,
+		"UpstreamUrl":       app.UpstreamUrl,
+		"MinWorkers":        app.MinWorkers,
+		"MaxWorkers":        app.MaxWorkers,
+		"UsersPerWorker":    app.UsersPerWorker,
+		"MaxUsersPerWorker": app.MaxUsersPerWorker,
+		"MaxDrainTime":      app.MaxDrainTime,
+		"Strategy":          app.Strategy,
+		"MemoryLimit":       app.MemoryLimit,
+		"CPULimit":          app.CPULimit,
+		"OpenFilesLimit":    app.OpenFilesLimit,
+		"WallTimeLimit":     app.WallTimeLimit,
+		"RunAsUser":         app.RunAsUser,
+		"RunAsGroup":        app.RunAsGroup,
+		"IsActive":          app.IsActive,
+		"RestrictAccess":    app.RestrictAccess,
 	}
 
 	tx := m.DB.Begin()
@@ -148,6 +235,17 @@ func (m *AppModelDB) Save(app App, oldName string) error {
 		tx.Rollback()
 		return fmt.Errorf("error while updating allowed groups for app: %s", oldName)
 	}
+	err = tx.Where("app_id = ?", currentApp.ID).Delete(&AppEnvVar{}).Error
+	if err == nil && len(envVars) > 0 {
+		for i := range envVars {
+			envVars[i].AppID = currentApp.ID
+		}
+		err = tx.Create(&envVars).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error while updating environment variables for app: %s", oldName)
+	}
 	tx.Commit()
 
 	return nil
@@ -156,7 +254,16 @@ func (m *AppModelDB) Save(app App, oldName string) error {
 // Delete an app
 func (m *AppModelDB) Delete(name string) error {
 	var app App
-	err := m.DB.Unscoped().Where("name = ?", name).Delete(&app).Error
+	err := m.DB.First(&app, "name = ?", name).Error
+	if err == nil {
+		err = m.DB.Where("app_id = ?", app.ID).Delete(&AppEnvVar{}).Error
+	}
+	if err == nil {
+		err = m.DB.Unscoped().Where("app_id = ?", app.ID).Delete(&Deployment{}).Error
+	}
+	if err == nil {
+		err = m.DB.Unscoped().Where("name = ?", name).Delete(&app).Error
+	}
 	if err != nil {
 		return fmt.Errorf("error while deleting app: %s", name)
 	}
@@ -182,16 +289,36 @@ func (m *AppModelDB) AsMap(app App) (map[string]interface{}, error) {
 		return nil, errors.New("unable to retrieve groups")
 	}
 	return map[string]interface{}{
-		"Name":            app.Name,
-		"Path":            app.Path,
-		"AppDir":          app.AppDir,
-		"GitSourceUrl":    app.GitSourceUrl,
-		"GitSourceBranch": app.GitSourceBranch,
-		"GitSourceToken":  app.GitSourceToken,
-		"Workers":         app.Workers,
-		"IsActive":        app.IsActive,
-		"RestrictAccess":  app.RestrictAccess,
-		"AllowedGroups":   m.groupsMap(app.AllowedGroups, allGroups),
+		"Name":              app.Name,
+		"Path":              app.Path,
+		"Hostnames":         app.Hostnames,
+		"AppSource":         app.AppSource,
+		"AppDir":            app.AppDir,
+		"Runtime":           app.Runtime,
+		"Command":           app.Command,
+		"RInstallation":     app.RInstallation,
+		"WatchChanges":      app.WatchChanges,
+		"GitSourceUrl":      app.GitSourceUrl,
+		"GitSourceBranch":   app.GitSourceBranch,
+		"HasGitSourceToken": app.GitSourceToken != "",
+		"GitRevision":       app.GitRevision,
+		"UpstreamUrl":       app.UpstreamUrl,
+		"MinWorkers":        app.MinWorkers,
+		"MaxWorkers":        app.MaxWorkers,
+		"UsersPerWorker":    app.UsersPerWorker,
+		"MaxUsersPerWorker": app.MaxUsersPerWorker,
+		"MaxDrainTime":      app.MaxDrainTime,
+		"Strategy":          app.Strategy,
+		"MemoryLimit":       app.MemoryLimit,
+		"CPULimit":          app.CPULimit,
+		"OpenFilesLimit":    app.OpenFilesLimit,
+		"WallTimeLimit":     app.WallTimeLimit,
+		"RunAsUser":         app.RunAsUser,
+		"RunAsGroup":        app.RunAsGroup,
+		"IsActive":          app.IsActive,
+		"RestrictAccess":    app.RestrictAccess,
+		"AllowedGroups":     m.groupsMap(app.AllowedGroups, allGroups),
+		"EnvVars":           EnvVarsAsMapSlice(app.EnvVars),
 	}, nil
 }
 
@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"os"
 
 	"github.com/appservR/appservR/modules/config"
 	"gorm.io/driver/sqlite"
@@ -30,11 +31,17 @@ func NewDB(conf config.Config) (*gorm.DB, error) {
 		if err != nil {
 			return nil, errors.New("failed to connect to the database")
 		}
+		// the database should not be readable by app instances running as other users
+		if dbPath != "file::memory:?cache=shared" {
+			os.Chmod(dbPath, 0600)
+		}
 	}
 
 	db.AutoMigrate(&User{})
 	db.AutoMigrate(&Group{})
 	db.AutoMigrate(&App{})
+	db.AutoMigrate(&AppEnvVar{})
+	db.AutoMigrate(&Deployment{})
 
 	return db, nil
 }
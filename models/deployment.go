@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type Deployment struct {
+	gorm.Model
+	AppID      uint
+	Revision   string // git commit or name of the app directory
+	AppSource  string
+	SourcePath string // app directory, bundle directory or git repository url
+	DeployedBy string
+}
+
+type DeploymentModel interface {
+	Record(appName string, deployment Deployment) error
+	ForApp(appName string) ([]Deployment, error)
+	Find(appName string, id uint) (Deployment, error)
+	AsMapSlice(deployments []Deployment) []map[string]interface{}
+}
+
+type DeploymentModelDB struct {
+	DB *gorm.DB
+}
+
+// Create a new deployment history model with db source
+func NewDeploymentModelDB(db *gorm.DB) *DeploymentModelDB {
+	return &DeploymentModelDB{
+		DB: db,
+	}
+}
+
+// Get the id of an app from its name
+func (m *DeploymentModelDB) appID(appName string) (uint, error) {
+	var app App
+	err := m.DB.First(&app, "name = ?", appName).Error
+	if err != nil {
+		return 0, fmt.Errorf("app %s does not exist", appName)
+	}
+	return app.ID, nil
+}
+
+// Add a deployment to the history of an app
+func (m *DeploymentModelDB) Record(appName string, deployment Deployment) error {
+	id, err := m.appID(appName)
+	if err != nil {
+		return err
+	}
+	deployment.AppID = id
+	err = m.DB.Create(&deployment).Error
+	if err != nil {
+		return errors.New("failed to record deployment")
+	}
+	return nil
+}
+
+// Get all deployments of an app, most recent first
+func (m *DeploymentModelDB) ForApp(appName string) ([]Deployment, error) {
+	id, err := m.appID(appName)
+	if err != nil {
+		return nil, err
+	}
+	var deployments []Deployment
+	err = m.DB.Where("app_id = ?", id).Order("id desc").Find(&deployments).Error
+	if err != nil {
+		return nil, errors.New("unable to retrieve deployments")
+	}
+	return deployments, nil
+}
+
+// Find a specific deployment of an app
+func (m *DeploymentModelDB) Find(appName string, id uint) (Deployment, error) {
+	appID, err := m.appID(appName)
+	if err != nil {
+		return Deployment{}, err
+	}
+	var deployment Deployment
+	err = m.DB.First(&deployment, "id = ? AND app_id = ?", id, appID).Error
+	if err != nil {
+		return Deployment{}, fmt.Errorf("deployment %d of app %s does not exist", id, appName)
+	}
+	return deployment, nil
+}
+
+// Get deployments as a slice of maps, directly usable in template
+func (m *DeploymentModelDB) AsMapSlice(deployments []Deployment) []map[string]interface{} {
+	res := make([]map[string]interface{}, len(deployments))
+	for i, d := range deployments {
+		res[i] = map[string]interface{}{
+			"ID":         d.ID,
+			"Date":       d.CreatedAt.Format("2006-01-02 15:04:05"),
+			"Revision":   d.Revision,
+			"AppSource":  d.AppSource,
+			"SourcePath": d.SourcePath,
+			"DeployedBy": d.DeployedBy,
+			"Current":    i == 0,
+		}
+	}
+	return res
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Value displayed instead of secret environment variables
+const SecretMask = "********"
+
+// An environment variable set for the instances of an app; secret values are encrypted in the database
+type AppEnvVar struct {
+	ID     uint `gorm:"primarykey"`
+	AppID  uint
+	Name   string
+	Value  string
+	Secret bool
+}
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Get the environment variables of an app in the form "key=value"
+func (app App) Environ() []string {
+	env := make([]string, len(app.EnvVars))
+	for i, v := range app.EnvVars {
+		env[i] = v.Name + "=" + v.Value
+	}
+	return env
+}
+
+// Load the key used to encrypt secrets from the APPSERVR_SECRET_KEY environment variable,
+// or from a key file which is generated if it does not exist; the variable is then removed
+// from the environment so that it is never passed to app instances
+func newSecretCipher(conf config.Config) (cipher.AEAD, error) {
+	key := os.Getenv("APPSERVR_SECRET_KEY")
+	os.Unsetenv("APPSERVR_SECRET_KEY")
+	if key == "" {
+		keyFile := conf.GetString("secrets.keyfile")
+		b, err := os.ReadFile(keyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			random := make([]byte, 32)
+			if _, err := rand.Read(random); err != nil {
+				return nil, err
+			}
+			b = []byte(hex.EncodeToString(random))
+			err = os.WriteFile(keyFile, b, 0600)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read secret key file %s", keyFile)
+		}
+		key = string(b)
+	}
+	hash := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a secret value
+func encryptSecret(c cipher.AEAD, value string) (string, error) {
+	nonce := make([]byte, c.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(c.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// Decrypt a secret value
+func decryptSecret(c cipher.AEAD, value string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(b) < c.NonceSize() {
+		return "", errors.New("invalid secret value")
+	}
+	res, err := c.Open(nil, b[:c.NonceSize()], b[c.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret value")
+	}
+	return string(res), nil
+}
+
+// Check environment variables names and encrypt secret values before saving them;
+// masked secret values are replaced by the values currently stored
+func (m *AppModelDB) encryptEnvVars(envVars []AppEnvVar, current []AppEnvVar) ([]AppEnvVar, error) {
+	stored := make(map[string]AppEnvVar)
+	for _, v := range current {
+		stored[v.Name] = v
+	}
+	res := make([]AppEnvVar, len(envVars))
+	for i, v := range envVars {
+		if !envVarName.MatchString(v.Name) {
+			return nil, fmt.Errorf("invalid environment variable name: %s", v.Name)
+		}
+		res[i] = AppEnvVar{Name: v.Name, Value: v.Value, Secret: v.Secret}
+		if !v.Secret {
+			continue
+		}
+		if prev, ok := stored[v.Name]; ok && prev.Secret && v.Value == SecretMask {
+			res[i].Value = prev.Value
+			continue
+		}
+		value, err := encryptSecret(m.secrets, v.Value)
+		if err != nil {
+			return nil, errors.New("unable to encrypt secret value")
+		}
+		res[i].Value = value
+	}
+	return res, nil
+}
+
+// Decrypt the secret values of environment variables loaded from the database
+func (m *AppModelDB) decryptEnvVars(app *App) error {
+	for i, v := range app.EnvVars {
+		if !v.Secret {
+			continue
+		}
+		value, err := decryptSecret(m.secrets, v.Value)
+		if err != nil {
+			return fmt.Errorf("environment variable %s of app %s: %s", v.Name, app.Name, err.Error())
+		}
+		app.EnvVars[i].Value = value
+	}
+	return nil
+}
+
+// Get environment variables as a slice of maps with secret values masked, directly usable in template
+func EnvVarsAsMapSlice(envVars []AppEnvVar) []map[string]interface{} {
+	res := make([]map[string]interface{}, len(envVars))
+	for i, v := range envVars {
+		value := v.Value
+		if v.Secret {
+			value = SecretMask
+		}
+		res[i] = map[string]interface{}{
+			"Name":   v.Name,
+			"Value":  value,
+			"Secret": v.Secret,
+		}
+	}
+	return res
+}
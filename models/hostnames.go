@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// Get the hostnames an app is served on, in addition to its path
+func (app App) HostnameList() []string {
+	hostnames := []string{}
+	for _, h := range strings.FieldsFunc(app.Hostnames, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		hostnames = append(hostnames, strings.ToLower(h))
+	}
+	return hostnames
+}
+
+// Check the hostnames of an app and format them as a comma separated list
+func normalizeHostnames(app App) (string, error) {
+	hostnames := app.HostnameList()
+	for _, h := range hostnames {
+		if !hostnamePattern.MatchString(h) {
+			return "", fmt.Errorf("invalid hostname: %s", h)
+		}
+	}
+	return strings.Join(hostnames, ","), nil
+}
+
+// Check that the path and hostnames of an app are not already used by another app
+func (m *AppModelDB) checkRouting(app App, oldName string) error {
+	var apps []App
+	err := m.DB.Select("name", "path", "hostnames").Find(&apps).Error
+	if err != nil {
+		return fmt.Errorf("unable to retrieve apps")
+	}
+	path := strings.TrimSuffix(app.Path, "/")
+	for _, other := range apps {
+		if other.Name == oldName {
+			continue
+		}
+		if strings.TrimSuffix(other.Path, "/") == path {
+			return fmt.Errorf("path %s is already used by app %s", app.Path, other.Name)
+		}
+		for _, h := range other.HostnameList() {
+			for _, h2 := range app.HostnameList() {
+				if h == h2 {
+					return fmt.Errorf("hostname %s is already used by app %s", h, other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
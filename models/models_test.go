@@ -2,6 +2,8 @@ package models
 
 import (
 	"errors"
+	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/appservR/appservR/modules/config"
@@ -17,6 +19,22 @@ func (c *MockConfig) ExecutableFolder() string {
 	return "."
 }
 
+func (c *MockConfig) GetInt(key string) int {
+	res, err := strconv.Atoi(c.GetString(key))
+	if err != nil {
+		return 0
+	}
+	return res
+}
+
+func (c *MockConfig) GetStringMapString(key string) map[string]string {
+	return map[string]string{}
+}
+
+func (c *MockConfig) GetStringSlice(key string) []string {
+	return nil
+}
+
 func (c *MockConfig) Logger() *config.Logger {
 	return &c.logger
 }
@@ -29,12 +47,13 @@ func (c *MockConfig) GetString(key string) string {
 	return ""
 }
 
-func setUp() (*gorm.DB, error) {
+func setUp(t *testing.T) (*gorm.DB, *MockConfig, error) {
 
 	conf := &MockConfig{
 		keys: map[string]string{
-			"database.type": "sqlite",
-			"database.path": "memory",
+			"database.type":   "sqlite",
+			"database.path":   "memory",
+			"secrets.keyfile": filepath.Join(t.TempDir(), "secret.key"),
 		},
 		logger: config.NewLogger(0),
 	}
@@ -42,15 +61,15 @@ func setUp() (*gorm.DB, error) {
 	db, err := NewDB(conf)
 
 	if err != nil {
-		return nil, errors.New("unable to initialize in memory database")
+		return nil, nil, errors.New("unable to initialize in memory database")
 	}
 
-	return db, nil
+	return db, conf, nil
 }
 
 func TestDataModelDB(t *testing.T) {
 
-	db, err := setUp()
+	db, conf, err := setUp(t)
 	if err != nil {
 		t.Error("unable to initialize database")
 	}
@@ -60,7 +79,7 @@ func TestDataModelDB(t *testing.T) {
 		t.Error("unable to initialize group model")
 	}
 
-	appModel, err := NewAppModelDB(db, groupModel)
+	appModel, err := NewAppModelDB(db, groupModel, conf)
 	if err != nil {
 		t.Error("unable to initialize app model")
 	}
@@ -121,10 +140,10 @@ func TestDataModelDB(t *testing.T) {
 	})
 	t.Run("app=create", func(t *testing.T) {
 		app := App{
-			Name:    "test-app",
-			Path:    "/test-app",
-			AppDir:  "apps/sample-app/",
-			Workers: 1,
+			Name:       "test-app",
+			Path:       "/test-app",
+			AppDir:     "apps/sample-app/",
+			MinWorkers: 1,
 		}
 		err := appModel.Save(app, "new")
 		if err != nil {
@@ -132,4 +151,97 @@ func TestDataModelDB(t *testing.T) {
 		}
 	})
 
+	t.Run("app=envvars", func(t *testing.T) {
+		app, _ := appModel.Find("test-app")
+		app.EnvVars = []AppEnvVar{
+			{Name: "DB_HOST", Value: "localhost"},
+			{Name: "DB_PASSWORD", Value: "pa55word", Secret: true},
+		}
+		err := appModel.Save(app, "test-app")
+		if err != nil {
+			t.Error("cannot save environment variables")
+		}
+		var stored AppEnvVar
+		db.First(&stored, "name = ?", "DB_PASSWORD")
+		if stored.Value == "pa55word" {
+			t.Error("secret value stored in clear")
+		}
+		// saving the masked value keeps the secret unchanged
+		app.EnvVars[1].Value = SecretMask
+		err = appModel.Save(app, "test-app")
+		app, _ = appModel.Find("test-app")
+		env := app.Environ()
+		if err != nil || len(env) != 2 || env[0] != "DB_HOST=localhost" || env[1] != "DB_PASSWORD=pa55word" {
+			t.Errorf("unexpected environment: %v", env)
+		}
+		app.EnvVars = []AppEnvVar{{Name: "1NVALID"}}
+		if appModel.Save(app, "test-app") == nil {
+			t.Error("should not accept invalid variable names")
+		}
+	})
+
+	t.Run("app=routing", func(t *testing.T) {
+		app, _ := appModel.Find("test-app")
+		app.Hostnames = "Sales.Example.com, dashboards.example.com"
+		err := appModel.Save(app, "test-app")
+		app, _ = appModel.Find("test-app")
+		if err != nil || app.Hostnames != "sales.example.com,dashboards.example.com" {
+			t.Errorf("unexpected hostnames: %s", app.Hostnames)
+		}
+		other := App{Name: "other-app", Path: "/test-app/", AppDir: "apps/sample-app/"}
+		if appModel.Save(other, "new") == nil {
+			t.Error("should not accept a path used by another app")
+		}
+		other.Path = "/other-app"
+		other.Hostnames = "sales.example.com"
+		if appModel.Save(other, "new") == nil {
+			t.Error("should not accept a hostname used by another app")
+		}
+		other.Hostnames = "sales.example.com:8080"
+		if appModel.Save(other, "new") == nil {
+			t.Error("should not accept invalid hostnames")
+		}
+		other.Hostnames = ""
+		for _, name := range []string{"../other-app", "apps/other-app", `apps\other-app`, ".."} {
+			other.Name = name
+			if appModel.Save(other, "new") == nil {
+				t.Errorf("should not accept app name %q", name)
+			}
+		}
+	})
+
+	deploymentModel := NewDeploymentModelDB(db)
+
+	t.Run("deployment=history", func(t *testing.T) {
+		for _, rev := range []string{"first", "second"} {
+			err := deploymentModel.Record("test-app", Deployment{Revision: rev, AppSource: "directory", DeployedBy: "admin"})
+			if err != nil {
+				t.Error("cannot record deployment")
+			}
+		}
+		deployments, err := deploymentModel.ForApp("test-app")
+		if err != nil || len(deployments) != 2 || deployments[0].Revision != "second" {
+			t.Error("did not return deployments most recent first")
+		}
+		_, err = deploymentModel.Find("sample-app", deployments[0].ID)
+		if err == nil {
+			t.Error("should not find a deployment of another app")
+		}
+	})
+
+	t.Run("deployment=delete", func(t *testing.T) {
+		deployments, _ := deploymentModel.ForApp("test-app")
+		if len(deployments) == 0 {
+			t.Fatal("no deployment recorded")
+		}
+		if err := appModel.Delete("test-app"); err != nil {
+			t.Fatal(err)
+		}
+		var count int64
+		db.Unscoped().Model(&Deployment{}).Where("app_id = ?", deployments[0].AppID).Count(&count)
+		if count != 0 {
+			t.Errorf("deployments of a deleted app should be deleted, %d left", count)
+		}
+	})
+
 }
@@ -0,0 +1,204 @@
+package applog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the log files currently open, which are never pruned
+var openLogs = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// The console output of an app instance, written to rotated log files and
+// with the last lines kept in memory
+type InstanceLog struct {
+	sync.Mutex
+	path      string
+	file      *os.File
+	size      int64
+	maxSize   int64
+	maxFiles  int
+	lines     []string
+	next      int
+	full      bool
+	listeners map[chan string]bool
+}
+
+// Create a log for an instance; if the log file cannot be opened, output is only kept in memory
+func NewInstanceLog(path string, maxSize int64, maxFiles int, bufferLines int) (*InstanceLog, error) {
+	if bufferLines < 1 {
+		bufferLines = 1
+	}
+	l := &InstanceLog{
+		path:      path,
+		maxSize:   maxSize,
+		maxFiles:  maxFiles,
+		lines:     make([]string, bufferLines),
+		listeners: make(map[chan string]bool),
+	}
+	openLogs.Lock()
+	openLogs.paths[filepath.Clean(path)] = true
+	openLogs.Unlock()
+	return l, l.open()
+}
+
+// Open the log file for appending
+func (l *InstanceLog) open() error {
+	err := os.MkdirAll(filepath.Dir(l.path), 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create log directory %s", filepath.Dir(l.path))
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open log file %s", l.path)
+	}
+	info, err := f.Stat()
+	if err == nil {
+		l.size = info.Size()
+	}
+	l.file = f
+	return nil
+}
+
+// Rename log files to keep at most maxFiles previous files and start a new file
+func (l *InstanceLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	l.size = 0
+	return l.open()
+}
+
+// Add a line of output
+func (l *InstanceLog) WriteLine(line string) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+	l.full = l.full || l.next == 0
+	if l.file != nil {
+		if l.maxSize > 0 && l.size+int64(len(line))+1 > l.maxSize {
+			l.rotate()
+		}
+		if l.file != nil {
+			n, _ := l.file.WriteString(line + "\n")
+			l.size += int64(n)
+		}
+	}
+	for ch := range l.listeners {
+		// drop lines for listeners which do not keep up
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Get the last lines of output kept in memory
+func (l *InstanceLog) Lines() []string {
+	l.Lock()
+	defer l.Unlock()
+	return l.buffered()
+}
+
+// Get the lines kept in memory without lock
+func (l *InstanceLog) buffered() []string {
+	if !l.full {
+		return append([]string{}, l.lines[:l.next]...)
+	}
+	return append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+// Get the last lines of output as a single string
+func (l *InstanceLog) String() string {
+	lines := l.Lines()
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Get a channel receiving new lines of output
+func (l *InstanceLog) Subscribe() chan string {
+	l.Lock()
+	defer l.Unlock()
+	ch := make(chan string, 100)
+	l.listeners[ch] = true
+	return ch
+}
+
+// Get the last lines of output and a channel receiving the lines written after them, so that
+// no line is missed or received twice
+func (l *InstanceLog) Follow() ([]string, chan string) {
+	l.Lock()
+	defer l.Unlock()
+	ch := make(chan string, 100)
+	l.listeners[ch] = true
+	return l.buffered(), ch
+}
+
+// Stop receiving new lines of output
+func (l *InstanceLog) Unsubscribe(ch chan string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.listeners, ch)
+}
+
+// Close the log file; lines are still kept in memory afterwards
+func (l *InstanceLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	openLogs.Lock()
+	delete(openLogs.paths, filepath.Clean(l.path))
+	openLogs.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Delete log files in a directory which have not been modified for a given duration, except
+// the files of logs still open, e.g. of running instances with no recent output
+func Prune(dir string, maxAge time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	openLogs.Lock()
+	defer openLogs.Unlock()
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if err == nil && !e.IsDir() && time.Since(info.ModTime()) > maxAge && !isOpen(path) {
+			os.Remove(path)
+		}
+	}
+}
+
+// Check whether a file is an open log file or one of its rotated files
+func isOpen(path string) bool {
+	path = filepath.Clean(path)
+	if ext := filepath.Ext(path); ext != "" {
+		if _, err := strconv.Atoi(ext[1:]); err == nil {
+			path = strings.TrimSuffix(path, ext)
+		}
+	}
+	return openLogs.paths[path]
+}
@@ -0,0 +1,90 @@
+package applog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstanceLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inst.log")
+	l, err := NewInstanceLog(path, 20, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := l.Subscribe()
+	for _, line := range []string{"line 1", "line 2", "line 3", "line 4", "line 5"} {
+		l.WriteLine(line)
+	}
+	l.Close()
+
+	t.Run("buffer", func(t *testing.T) {
+		got := strings.Join(l.Lines(), ",")
+		if got != "line 3,line 4,line 5" {
+			t.Errorf("expected last 3 lines, got %s", got)
+		}
+	})
+	t.Run("subscribe", func(t *testing.T) {
+		if line := <-ch; line != "line 1" {
+			t.Errorf("expected first line, got %s", line)
+		}
+	})
+	t.Run("follow", func(t *testing.T) {
+		l, _ := NewInstanceLog("", 0, 0, 3)
+		l.WriteLine("line 1")
+		lines, ch := l.Follow()
+		defer l.Unsubscribe(ch)
+		l.WriteLine("line 2")
+		if got := strings.Join(lines, ","); got != "line 1" {
+			t.Errorf("expected the lines written before, got %s", got)
+		}
+		if line := <-ch; line != "line 2" || len(ch) != 0 {
+			t.Errorf("expected only the lines written after, got %s", line)
+		}
+	})
+	t.Run("rotation", func(t *testing.T) {
+		b, err := os.ReadFile(path)
+		if err != nil || string(b) != "line 5\n" {
+			t.Errorf("unexpected current log file content: %q", string(b))
+		}
+		b, err = os.ReadFile(path + ".2")
+		if err != nil || string(b) != "line 1\nline 2\n" {
+			t.Errorf("unexpected rotated log file content: %q", string(b))
+		}
+		if _, err := os.Stat(path + ".3"); err == nil {
+			t.Errorf("expected at most 2 rotated files")
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	live, err := NewInstanceLog(filepath.Join(dir, "live.log"), 0, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	stopped, err := NewInstanceLog(filepath.Join(dir, "stopped.log"), 0, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.Close()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"live.log", "stopped.log"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Prune(dir, 24*time.Hour)
+
+	if _, err := os.Stat(filepath.Join(dir, "live.log")); err != nil {
+		t.Errorf("the log of a running instance should not be pruned")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stopped.log")); err == nil {
+		t.Errorf("expected old log file to be pruned")
+	}
+}
@@ -0,0 +1,175 @@
+package appruntime
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appservR/appservR/models"
+)
+
+// A runtime defines how an app is launched and which files its directory should contain
+type AppRuntime interface {
+	Command(dir string, rscript string, port string) ([]string, error) // get the executable and arguments to run the app
+	Validate(dir string) error                                         // check that the app directory can be served
+}
+
+var Runtimes = struct {
+	SHINY     string
+	PLUMBER   string
+	RMARKDOWN string
+	QUARTO    string
+	COMMAND   string
+}{
+	SHINY:     "shiny",
+	PLUMBER:   "plumber",
+	RMARKDOWN: "rmarkdown",
+	QUARTO:    "quarto",
+	COMMAND:   "command",
+}
+
+// Get the runtime selected for an app (Shiny app by default)
+func NewAppRuntime(app models.App) AppRuntime {
+	switch app.Runtime {
+	case Runtimes.PLUMBER:
+		return &PlumberRuntime{}
+	case Runtimes.RMARKDOWN:
+		return &DocumentRuntime{Extension: ".Rmd", Serve: "rmarkdown::run('%s', shiny_args=list(port=%s, launch.browser=FALSE))"}
+	case Runtimes.QUARTO:
+		return &DocumentRuntime{Extension: ".qmd", Serve: "quarto::quarto_serve('%s', port=%s, browse=FALSE)"}
+	case Runtimes.COMMAND:
+		return &CommandRuntime{Template: app.Command}
+	default:
+		return &ShinyRuntime{}
+	}
+}
+
+// A Shiny app with app.R or server.R and ui.R files
+type ShinyRuntime struct{}
+
+func (r *ShinyRuntime) Command(dir string, rscript string, port string) ([]string, error) {
+	return []string{rscript, "-e", "shiny::runApp('.', port=" + port + ")"}, nil
+}
+
+func (r *ShinyRuntime) Validate(dir string) error {
+	_, errApp := os.Stat(filepath.Join(dir, "app.R"))
+	_, errServer := os.Stat(filepath.Join(dir, "server.R"))
+	_, errUI := os.Stat(filepath.Join(dir, "ui.R"))
+	if errApp != nil && (errServer != nil || errUI != nil) {
+		return errors.New("app directory does not contain app.R or server.R and ui.R files")
+	}
+	return nil
+}
+
+// A Plumber API defined in plumber.R or entrypoint.R
+type PlumberRuntime struct{}
+
+func (r *PlumberRuntime) Command(dir string, rscript string, port string) ([]string, error) {
+	return []string{rscript, "-e", "plumber::pr_run(plumber::plumb(dir='.'), port=" + port + ")"}, nil
+}
+
+func (r *PlumberRuntime) Validate(dir string) error {
+	_, errPlumber := os.Stat(filepath.Join(dir, "plumber.R"))
+	_, errEntrypoint := os.Stat(filepath.Join(dir, "entrypoint.R"))
+	if errPlumber != nil && errEntrypoint != nil {
+		return errors.New("app directory does not contain plumber.R or entrypoint.R file")
+	}
+	return nil
+}
+
+// An interactive R Markdown or Quarto document; the index document is served if there are several
+type DocumentRuntime struct {
+	Extension string
+	Serve     string // R expression to serve the document, formatted with document name and port
+}
+
+func (r *DocumentRuntime) Command(dir string, rscript string, port string) ([]string, error) {
+	doc, err := r.document(dir)
+	if err != nil {
+		return nil, err
+	}
+	return []string{rscript, "-e", fmt.Sprintf(r.Serve, doc, port)}, nil
+}
+
+func (r *DocumentRuntime) Validate(dir string) error {
+	_, err := r.document(dir)
+	return err
+}
+
+// Find the document to serve in the app directory
+func (r *DocumentRuntime) document(dir string) (string, error) {
+	docs, err := filepath.Glob(filepath.Join(dir, "*"+r.Extension))
+	if err != nil || len(docs) == 0 {
+		return "", fmt.Errorf("app directory does not contain any %s document", r.Extension)
+	}
+	if len(docs) == 1 {
+		return filepath.Base(docs[0]), nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index"+r.Extension)); err != nil {
+		return "", fmt.Errorf("app directory contains several documents but no index%s", r.Extension)
+	}
+	return "index" + r.Extension, nil
+}
+
+// An arbitrary command with {port} and optionally {rscript} placeholders
+type CommandRuntime struct {
+	Template string
+}
+
+func (r *CommandRuntime) Command(dir string, rscript string, port string) ([]string, error) {
+	if err := r.Validate(dir); err != nil {
+		return nil, err
+	}
+	args := splitCommand(r.Template)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{port}", port)
+		args[i] = strings.ReplaceAll(args[i], "{rscript}", rscript)
+	}
+	return args, nil
+}
+
+func (r *CommandRuntime) Validate(dir string) error {
+	if len(splitCommand(r.Template)) == 0 {
+		return errors.New("no command provided")
+	}
+	if !strings.Contains(r.Template, "{port}") {
+		return errors.New("command does not contain the {port} placeholder")
+	}
+	return nil
+}
+
+// Split a command line on spaces, keeping quoted arguments together
+func splitCommand(command string) []string {
+	args := []string{}
+	current := strings.Builder{}
+	inArg := false
+	var quote rune
+	for _, c := range command {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
@@ -0,0 +1,58 @@
+package appruntime
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appservR/appservR/models"
+)
+
+func TestAppRuntime(t *testing.T) {
+
+	t.Run("command=split", func(t *testing.T) {
+		args, err := NewAppRuntime(models.App{Runtime: "command", Command: `python3 -m "http.server" {port}`}).Command(".", "Rscript", "4000")
+		if err != nil || !reflect.DeepEqual(args, []string{"python3", "-m", "http.server", "4000"}) {
+			t.Error("command not parsed correctly")
+		}
+		err = NewAppRuntime(models.App{Runtime: "command", Command: "python3 -m http.server"}).Validate(".")
+		if err == nil {
+			t.Error("command without port placeholder should not be valid")
+		}
+	})
+
+	t.Run("rmarkdown=document", func(t *testing.T) {
+		dir := t.TempDir()
+		runtime := NewAppRuntime(models.App{Runtime: "rmarkdown"})
+		if runtime.Validate(dir) == nil {
+			t.Error("empty directory should not be valid")
+		}
+		os.WriteFile(filepath.Join(dir, "report.Rmd"), []byte{}, 0600)
+		args, err := runtime.Command(dir, "Rscript", "4000")
+		if err != nil || args[2] != "rmarkdown::run('report.Rmd', shiny_args=list(port=4000, launch.browser=FALSE))" {
+			t.Error("single document not served")
+		}
+		os.WriteFile(filepath.Join(dir, "other.Rmd"), []byte{}, 0600)
+		if runtime.Validate(dir) == nil {
+			t.Error("several documents without index should not be valid")
+		}
+		os.WriteFile(filepath.Join(dir, "index.Rmd"), []byte{}, 0600)
+		args, err = runtime.Command(dir, "Rscript", "4000")
+		if err != nil || args[2] != "rmarkdown::run('index.Rmd', shiny_args=list(port=4000, launch.browser=FALSE))" {
+			t.Error("index document not served")
+		}
+	})
+
+	t.Run("shiny=validate", func(t *testing.T) {
+		dir := t.TempDir()
+		runtime := NewAppRuntime(models.App{})
+		if runtime.Validate(dir) == nil {
+			t.Error("empty directory should not be valid")
+		}
+		os.WriteFile(filepath.Join(dir, "app.R"), []byte{}, 0600)
+		if runtime.Validate(dir) != nil {
+			t.Error("directory with app.R should be valid")
+		}
+	})
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/appservR/appservR/models"
@@ -15,106 +18,253 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+var errNoInstance = errors.New("no running instance available")
+var errAppFailed = errors.New("app instances failed to start")
+
+// Interval between samples of the cpu usage of instances
+const cpuSampleInterval = 5 * time.Second
+
 // A struct to hold objects related to a running app
 type AppProxy struct {
 	sync.RWMutex
-	App             models.App                // the app settings
-	AppSource       appsource.AppSource       // the app R source files
-	StatusStream    *ssehandler.MessageBroker // global message broker for SSEvents
-	Instances       map[string]*Instance      // running instances of the app
-	Sessions        map[string]*Session       // session started by users
-	SessionsGCTimer *time.Timer               // timer to garbage collect sessions
-	config          config.Config             // global config object
+	sourceLock       sync.Mutex                // serializes changes of the app source, which may take long, without blocking requests
+	App              models.App                // the app settings
+	AppSource        appsource.AppSource       // the app R source files
+	StatusStream     *ssehandler.MessageBroker // global message broker for SSEvents
+	Instances        map[string]*Instance      // running instances of the app
+	Sessions         map[string]*Session       // session started by users
+	SessionsGCTicker *time.Ticker              // ticker to garbage collect sessions and reevaluate load
+	lastScaleUp      time.Time                 // last time new instances were started
+	lastDemand       time.Time                 // last time a session was requested
+	queue            []*queueEntry             // visitors waiting for an instance to accept new users
+	picked           map[string]uint64         // number of the last session given to each instance, for round-robin
+	pickCount        uint64                    // number of sessions given to instances, for round-robin
+	done             chan struct{}             // closed when the app is stopped or deleted
+	config           config.Config             // global config object
 }
 
 // Create a new app proxy
 func NewAppProxy(app models.App, msgBroker *ssehandler.MessageBroker, config config.Config) (*AppProxy, error) {
 	p := &AppProxy{
-		App:             app,
-		AppSource:       appsource.NewAppSource(app, config, false),
-		StatusStream:    msgBroker,
-		Instances:       map[string]*Instance{},
-		Sessions:        map[string]*Session{},
-		SessionsGCTimer: time.NewTimer(time.Second * time.Duration(30)),
-		config:          config,
+		App:              app,
+		AppSource:        appsource.NewAppSource(app, config, false),
+		StatusStream:     msgBroker,
+		Instances:        map[string]*Instance{},
+		Sessions:         map[string]*Session{},
+		SessionsGCTicker: time.NewTicker(time.Second * time.Duration(30)),
+		done:             make(chan struct{}),
+		config:           config,
 	}
+	p.watchSource()
 	go p.Rescale()
-	// Delete unused sessions every 30s
+	// Delete unused sessions and rescale according to load every 30s, deleting source revisions
+	// no longer used, and sample the cpu usage of instances for the least cpu strategy
 	go func() {
-		<-p.SessionsGCTimer.C
-		p.Lock()
-		defer p.Unlock()
-		anyExpired := false
-		for id, sess := range p.Sessions {
-			expired := sess.LastActive < time.Now().Unix()-30*60
-			if expired {
-				p.doCloseSession(id)
+		cpuTicker := time.NewTicker(cpuSampleInterval)
+		defer cpuTicker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-p.SessionsGCTicker.C:
+				p.collectSessions()
+				p.Rescale()
+				p.pruneSource()
+			case <-cpuTicker.C:
+				p.sampleCPU()
 			}
-			anyExpired = anyExpired || expired
-		}
-		if anyExpired {
-			go p.Rescale()
 		}
 	}()
 	return p, nil
 }
 
-// Cleanup before deleting app
-func (p *AppProxy) Cleanup() {
+// Delete sessions inactive for more than 30 minutes; dedicated instances are released
+// when their user has left for the scaling cooldown delay
+func (p *AppProxy) collectSessions() {
+	p.Lock()
+	defer p.Unlock()
+	cooldown := time.Duration(p.config.GetInt("scaling.cooldown")) * time.Second
+	for id, sess := range p.Sessions {
+		if !sess.active(30 * 60) {
+			p.doCloseSession(id)
+		} else if p.dedicated() && sess.Instance != nil && sess.Instance.Status() == instStatus.RUNNING &&
+			sess.Instance.IdleTime() >= cooldown {
+			p.doCloseSession(id)
+		}
+	}
+}
+
+// Stop all instances of the app, leaving its source files on disk
+func (p *AppProxy) Stop() {
 	p.Lock()
 	defer p.Unlock()
-	// Stop all instances
+	p.stop()
+}
+
+// Stop all instances and background tasks of the app without lock
+func (p *AppProxy) stop() {
 	for _, inst := range p.Instances {
 		inst.Stop()
 	}
-	// Stop sessions cleanup timer
-	p.SessionsGCTimer.Stop()
+	// Stop sessions cleanup ticker
+	p.SessionsGCTicker.Stop()
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
 }
 
-// Find an existing session or create a new session and selects
-// the most appropriate running instance according to current load
-func (p *AppProxy) GetSession(sessionID string, userCount bool) (*Session, error) {
+// Cleanup before deleting app
+func (p *AppProxy) Cleanup() {
 	p.Lock()
+	defer p.Unlock()
+	p.stop()
+	p.AppSource.Cleanup()
+}
+
+// Find an existing session of a user or create a new session and select a running instance
+// according to the app strategy
+func (p *AppProxy) GetSession(sessionID string, user string) (*Session, error) {
+	// most requests belong to a session on a running instance, which only needs to be found
+	p.RLock()
+	sess, ok := p.Sessions[sessionID]
+	if ok && sess.User == user && sess.Instance != nil {
+		if status := sess.Instance.Status(); status == instStatus.RUNNING || status == instStatus.PHASING_OUT {
+			sess.touch()
+			p.RUnlock()
+			return sess, nil
+		}
+	}
+	p.RUnlock()
+
+	p.Lock()
+	sess, ok = p.Sessions[sessionID]
+	// a new user or a request with no running instance may require more instances; user
+	// counts are updated when rescaling
+	rescale := !ok
 	defer func() {
 		p.Unlock()
-		go p.ReportStatus()
+		if rescale {
+			go p.Rescale()
+		} else {
+			go p.ReportStatus()
+		}
 	}()
+	p.lastDemand = time.Now()
 
-	sess, ok := p.Sessions[sessionID]
-	if !ok {
-		sess = NewSession(p)
+	// sessions cannot be taken over by another user
+	if !ok || sess.User != user {
+		sess = NewSession(p, user)
 	}
 
-	// if session already exist and is still valid
+	// if session already exist and is still valid, including on an instance phasing out
 	if sess.Instance != nil {
-		if sess.Instance.Status() == instStatus.RUNNING {
-			sess.LastActive = time.Now().Unix()
-			if userCount {
-				sess.Instance.SetUserCount(1, true)
-			}
+		status := sess.Instance.Status()
+		if status == instStatus.RUNNING || status == instStatus.PHASING_OUT {
+			sess.touch()
 			return sess, nil
 		}
+		// a dedicated instance starting or restarting is kept for its session
+		if p.dedicated() && (status == instStatus.STARTING || status == instStatus.ERROR) {
+			sess.touch()
+			return sess, errNoInstance
+		}
 	}
 
-	// else, simple choice strategy: lowest user count of all running instances
-	bestInstID := ""
-	bestUC := 0
-	for id, inst := range p.Instances {
-		uc := inst.UserCount()
-		if inst.Status() == instStatus.RUNNING && (bestInstID == "" || uc < bestUC) {
-			bestInstID = id
-			bestUC = uc
+	// else, choose among running instances which can accept a new user,
+	// preferring instances running the latest version of the app
+	candidates := []*Instance{}
+	upToDate := []*Instance{}
+	failed := false
+	saturated := false
+	for _, inst := range p.Instances {
+		if inst.Status() == instStatus.FAILED {
+			failed = true
+		}
+		if inst.Status() != instStatus.RUNNING {
+			continue
+		}
+		if p.full(inst) {
+			saturated = true
+			continue
 		}
+		candidates = append(candidates, inst)
+		if !inst.Outdated() {
+			upToDate = append(upToDate, inst)
+		}
+	}
+	if len(upToDate) > 0 {
+		candidates = upToDate
 	}
-	if bestInstID != "" {
-		sess.Instance = p.Instances[bestInstID]
+	if best := p.pickInstance(candidates); best != nil {
+		sess.Instance = best
+		sess.touch()
 		p.Sessions[sess.ID] = sess
-		if userCount {
-			sess.Instance.SetUserCount(1, true)
-		}
+		// counted until user counts are updated, for the next sessions to be spread
+		best.SetUserCount(1, true)
 		return sess, nil
 	}
-	return nil, errors.New("no running instance available")
+	rescale = true
+	// with one instance per user, a new instance is started for the session
+	if p.dedicated() {
+		sess.Instance = nil
+		started, err := p.startDedicated(sess)
+		if err != nil {
+			p.config.Logger().Warning("unable to start an instance of " + p.App.Name + ": " + err.Error())
+			return nil, errAppFailed
+		}
+		if started {
+			return sess, errNoInstance
+		}
+	}
+	if saturated {
+		return nil, errSaturated
+	}
+	if failed {
+		return nil, errAppFailed
+	}
+	return nil, errNoInstance
+}
+
+// Check whether a session exists and belongs to a user
+func (p *AppProxy) HasSession(sessionID string, user string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	sess, ok := p.Sessions[sessionID]
+	return ok && sess.User == user
+}
+
+// Register a request or websocket opened in a session; the app is not locked as this is
+// done for every request, user counts are updated when rescaling
+func (p *AppProxy) Connect(sess *Session) {
+	wasActive := sess.active(int64(p.config.GetInt("sessions.idletimeout")))
+	atomic.AddInt32(&sess.conns, 1)
+	sess.touch()
+	// a user coming back may require more instances
+	if !wasActive {
+		go p.Rescale()
+	}
+}
+
+// Register the end of a request or websocket of a session
+func (p *AppProxy) Disconnect(sess *Session) {
+	atomic.AddInt32(&sess.conns, -1)
+	sess.touch()
+}
+
+// Update the number of users connected to each instance from its active sessions
+func (p *AppProxy) countUsers() {
+	idleTimeout := int64(p.config.GetInt("sessions.idletimeout"))
+	counts := map[*Instance]int{}
+	for _, sess := range p.Sessions {
+		if sess.Instance != nil && sess.active(idleTimeout) {
+			counts[sess.Instance]++
+		}
+	}
+	for _, inst := range p.Instances {
+		inst.SetUserCount(counts[inst], false)
+	}
 }
 
 // Check if the current user is allowed to access the app
@@ -143,66 +293,181 @@ func (p *AppProxy) Authorized(c *gin.Context) bool {
 	}
 }
 
-// Rescale to appropriate number of workers (for now, a fixed user-defined number of workers)
+// Get the minimum and maximum number of workers from app settings
+func (p *AppProxy) workersRange() (int, int) {
+	minWorkers := p.App.MinWorkers
+	if minWorkers < 0 {
+		minWorkers = 0
+	}
+	maxWorkers := p.App.MaxWorkers
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+	// an app scaled to zero can still start one instance on demand
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	return minWorkers, maxWorkers
+}
+
+// Rescale to appropriate number of workers, between min and max workers according to
+// the number of connected users per instance
 func (p *AppProxy) Rescale() {
 	p.Lock()
 	defer func() {
 		p.Unlock()
 		go p.ReportStatus()
 	}()
-	// count active instances
-	nbInst := 0
+	// app has been deleted
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	// external apps have no instance: instances left from a previous app source are stopped
+	if p.upstream() != nil {
+		p.stopInstances()
+		return
+	}
+	p.countUsers()
+	// count active instances and connected users, distinguishing outdated instances; instances
+	// waiting to be restarted or failed keep their place, unless they are outdated
+	insts := []*Instance{}
+	outdated := []*Instance{}
+	nbReady := 0
+	userCount := 0
 	for _, inst := range p.Instances {
 		status := inst.Status()
-		if status == instStatus.STARTING || status == instStatus.RUNNING {
-			nbInst++
+		if inst.Down() {
+			if inst.Outdated() || !p.App.IsActive {
+				inst.Stop()
+				delete(p.Instances, inst.ID)
+			} else {
+				insts = append(insts, inst)
+			}
+		} else if status == instStatus.STARTING || status == instStatus.RUNNING {
+			userCount += inst.UserCount()
+			if inst.Outdated() {
+				outdated = append(outdated, inst)
+				continue
+			}
+			insts = append(insts, inst)
+			if status == instStatus.RUNNING {
+				nbReady++
+			}
+		}
+	}
+	nbInst := len(insts)
+	minWorkers, maxWorkers := p.workersRange()
+	cooldown := time.Duration(p.config.GetInt("scaling.cooldown")) * time.Second
+	targetWorkers := minWorkers
+	// keep at least one instance when sessions were recently requested
+	if targetWorkers == 0 && time.Since(p.lastDemand) < cooldown {
+		targetWorkers = 1
+	}
+	// visitors waiting in the queue also count as demand
+	userCount += len(p.queue)
+	if p.dedicated() {
+		// one instance per session, plus the minimum number of workers kept ready for new users
+		targetWorkers = minWorkers
+		for _, inst := range insts {
+			if p.sessionCount(inst) > 0 {
+				targetWorkers++
+			}
+		}
+		if targetWorkers > maxWorkers {
+			targetWorkers = maxWorkers
+		}
+	} else {
+		for _, usersPerWorker := range []int{p.App.UsersPerWorker, p.App.MaxUsersPerWorker} {
+			if usersPerWorker <= 0 {
+				continue
+			}
+			needed := (userCount + usersPerWorker - 1) / usersPerWorker
+			if needed > targetWorkers {
+				targetWorkers = needed
+			}
+			if targetWorkers > maxWorkers {
+				targetWorkers = maxWorkers
+			}
 		}
 	}
-	targetWorkers := p.App.Workers
 	if !p.App.IsActive {
 		targetWorkers = 0
+		maxWorkers = 0
 	}
 	// if too few instances, start new ones
 	for w := 0; w < targetWorkers-nbInst; w++ {
-		inst := NewInstance(p.App.Name, p.AppSource.Path(), p.config)
+		inst := NewInstance(p.App, p.AppSource.Path(), p.config)
+		// outdated instances can be phased out as soon as the new ones are ready
+		inst.onChange = p.Rescale
 		inst.Start()
 		p.Instances[inst.ID] = inst
+		p.lastScaleUp = time.Now()
 	}
-	// if too many instances, phase out the one with less users connected
+	// if too many instances, phase out the ones with less users connected: right away above
+	// the maximum number of workers, otherwise only when they have been idle for the cooldown delay
 	if nbInst > targetWorkers {
-		insts := make([]*Instance, nbInst)
-		i := 0
-		for _, inst := range p.Instances {
-			if inst.Status() == instStatus.RUNNING || inst.Status() == instStatus.STARTING {
-				insts[i] = inst
-				i++
-			}
-		}
 		sort.Slice(insts, func(i int, j int) bool {
+			if insts[i].Down() != insts[j].Down() {
+				return insts[i].Down()
+			}
+			if si, sj := p.sessionCount(insts[i]), p.sessionCount(insts[j]); p.dedicated() && si != sj {
+				return si < sj
+			}
 			return insts[i].UserCount() < insts[j].UserCount()
 		})
-		for i = 0; i < nbInst-targetWorkers; i++ {
-			insts[i].PhaseOut()
+		cooledDown := time.Since(p.lastScaleUp) >= cooldown
+		for i := 0; i < nbInst-targetWorkers; i++ {
+			if insts[i].Down() {
+				insts[i].Stop()
+				delete(p.Instances, insts[i].ID)
+			} else if nbInst-i > maxWorkers || (cooledDown && insts[i].IdleTime() >= cooldown) {
+				insts[i].PhaseOut()
+			}
 		}
 	}
-	// stopped phased out instances with no connected users
+	// phase out outdated instances as soon as enough up-to-date instances are running
+	maxDrain := time.Duration(p.App.MaxDrainTime) * time.Minute
+	for _, inst := range outdated {
+		if nbReady >= targetWorkers || inst.Status() == instStatus.STARTING {
+			inst.PhaseOut()
+			if maxDrain > 0 {
+				time.AfterFunc(maxDrain, p.Rescale)
+			}
+		}
+	}
+	// stop phased out instances with no connected users, or for which the maximum drain time
+	// is exceeded, closing remaining sessions
 	for _, inst := range p.Instances {
 		status := inst.Status()
 		if status == instStatus.PHASING_OUT {
-			if inst.UserCount() == 0 {
+			if inst.UserCount() == 0 || (maxDrain > 0 && inst.PhasingOutTime() >= maxDrain) {
 				err := inst.Stop()
 				if err == nil {
 					delete(p.Instances, inst.ID)
+					for id, sess := range p.Sessions {
+						if sess.Instance == inst {
+							p.doCloseSession(id)
+						}
+					}
 				}
 			}
 		}
 	}
 }
 
-// End a specific session without lock and without rescaling
+// End a specific session without lock and without rescaling; a dedicated instance
+// is phased out with its session so that it is never shared with another user
 func (p *AppProxy) doCloseSession(sessionID string) error {
-	if _, ok := p.Sessions[sessionID]; ok {
+	if sess, ok := p.Sessions[sessionID]; ok {
 		delete(p.Sessions, sessionID)
+		if p.dedicated() && sess.Instance != nil {
+			status := sess.Instance.Status()
+			if status == instStatus.STARTING || status == instStatus.RUNNING {
+				sess.Instance.PhaseOut()
+			}
+		}
 		return nil
 	}
 	return errors.New("cannot find session")
@@ -217,28 +482,256 @@ func (p *AppProxy) CloseSession(sessionID string) error {
 	return err
 }
 
-// Stop or restart all instances, while keeping existing connections
+// Restart all instances: new instances are started and current instances are phased out
+// once the new ones are ready, while keeping existing connections
 func (p *AppProxy) phaseOut() {
 	for _, i := range p.Instances {
-		i.PhaseOut()
+		i.MarkOutdated()
 	}
 	go p.Rescale()
 }
 
-// Apply changes to app settings
-func (p *AppProxy) Update(app models.App) {
+// Fetch the latest version of the app source and restart all instances; the app keeps
+// serving requests during the download, and running instances keep their revision
+func (p *AppProxy) Redeploy() error {
+	p.sourceLock.Lock()
+	defer p.sourceLock.Unlock()
+	source, err := p.updatableSource()
+	if err != nil {
+		return err
+	}
+	revision, err := source.Fetch()
+	if err == nil {
+		err = source.Checkout(revision)
+	}
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.App.GitRevision = ""
+	p.phaseOut()
+	return nil
+}
+
+// Switch the app source to a previous version and restart all instances
+func (p *AppProxy) Checkout(revision string) error {
+	p.sourceLock.Lock()
+	defer p.sourceLock.Unlock()
+	source, err := p.updatableSource()
+	if err != nil {
+		return err
+	}
+	err = source.Checkout(revision)
+	if err != nil {
+		return err
+	}
 	p.Lock()
 	defer p.Unlock()
+	p.App.GitRevision = revision
+	p.phaseOut()
+	return nil
+}
+
+// Get the app source if it has revisions; the source is only replaced with the source lock
+func (p *AppProxy) updatableSource() (appsource.UpdatableSource, error) {
+	p.RLock()
+	defer p.RUnlock()
+	source, ok := p.AppSource.(appsource.UpdatableSource)
+	if !ok {
+		return nil, errors.New("app source has no revisions")
+	}
+	return source, nil
+}
+
+// Delete the revisions of the app source which are no longer run by any instance
+func (p *AppProxy) pruneSource() {
+	p.sourceLock.Lock()
+	defer p.sourceLock.Unlock()
+	source, err := p.updatableSource()
+	if err != nil {
+		return
+	}
+	p.RLock()
+	appName := p.App.Name
+	inUse := []string{}
+	for _, inst := range p.Instances {
+		inUse = append(inUse, inst.AppDir())
+	}
+	p.RUnlock()
+	err = source.Prune(inUse)
+	if err != nil {
+		p.config.Logger().Warning("unable to delete old revisions of app " + appName + ": " + err.Error())
+	}
+}
+
+// Get an identifier of the current version of the app source
+func (p *AppProxy) Revision() string {
+	p.RLock()
+	defer p.RUnlock()
+	if source, ok := p.AppSource.(appsource.UpdatableSource); ok {
+		return source.Revision()
+	}
+	if upstream := p.upstream(); upstream != nil {
+		return upstream.String()
+	}
+	return filepath.Base(p.AppSource.Path())
+}
+
+// Watch app source files if enabled, to restart instances when they change
+func (p *AppProxy) watchSource() {
+	source, ok := p.AppSource.(appsource.WatchableSource)
+	if !ok {
+		return
+	}
+	source.StopWatching()
+	if !p.App.WatchChanges || p.AppSource.Error() != nil {
+		return
+	}
+	logger := p.config.Logger()
+	debounce := time.Duration(p.config.GetInt("watch.debounce")) * time.Second
+	err := source.Watch(debounce, func() {
+		p.Lock()
+		defer p.Unlock()
+		logger.Info("files of app " + p.App.Name + " changed, restarting instances")
+		p.phaseOut()
+	})
+	if err != nil {
+		logger.Warning("unable to watch files of app " + p.App.Name + ": " + err.Error())
+	}
+}
+
+// Apply changes to app settings and get the previous settings; a new app source is
+// prepared before locking the app, which keeps serving requests during a download
+func (p *AppProxy) Update(app models.App) models.App {
+	p.sourceLock.Lock()
+	defer p.sourceLock.Unlock()
+	p.RLock()
 	prevApp := p.App
+	p.RUnlock()
+	sourceChanged := prevApp.AppSource != app.AppSource || prevApp.AppDir != app.AppDir ||
+		prevApp.GitSourceUrl != app.GitSourceUrl || prevApp.GitSourceBranch != app.GitSourceBranch ||
+		prevApp.GitSourceToken != app.GitSourceToken || prevApp.Runtime != app.Runtime || prevApp.Command != app.Command ||
+		prevApp.UpstreamUrl != app.UpstreamUrl
+	var source appsource.AppSource
+	if sourceChanged {
+		source = appsource.NewAppSource(app, p.config, false)
+	}
+
+	p.Lock()
+	defer p.Unlock()
 	p.App = app
-	if prevApp.AppDir != app.AppDir {
-		p.AppSource = appsource.NewAppSource(app, p.config, false)
+	if sourceChanged {
+		if prev, ok := p.AppSource.(appsource.WatchableSource); ok {
+			prev.StopWatching()
+		}
+		p.AppSource = source
+	}
+	if sourceChanged || prevApp.WatchChanges != app.WatchChanges {
+		p.watchSource()
 	}
-	if prevApp.AppDir != app.AppDir || prevApp.IsActive != app.IsActive {
+	// settings applied when instances start
+	settingsChanged := !reflect.DeepEqual(prevApp.Environ(), app.Environ()) || prevApp.RInstallation != app.RInstallation ||
+		!reflect.DeepEqual(appLimits(prevApp), appLimits(app)) ||
+		prevApp.RunAsUser != app.RunAsUser || prevApp.RunAsGroup != app.RunAsGroup
+	// instances shared by several users cannot become dedicated, and conversely
+	strategyChanged := prevApp.Strategy != app.Strategy &&
+		(prevApp.Strategy == config.Strategies.DEDICATED || app.Strategy == config.Strategies.DEDICATED)
+	if sourceChanged || settingsChanged || strategyChanged || prevApp.IsActive != app.IsActive {
 		p.phaseOut()
-	} else if prevApp.Workers != app.Workers {
+	} else if prevApp.MinWorkers != app.MinWorkers || prevApp.MaxWorkers != app.MaxWorkers ||
+		prevApp.UsersPerWorker != app.UsersPerWorker || prevApp.MaxUsersPerWorker != app.MaxUsersPerWorker ||
+		prevApp.MaxDrainTime != app.MaxDrainTime {
 		go p.Rescale()
 	}
+	return prevApp
+}
+
+// Get an instance of the app by ID
+func (p *AppProxy) getInstance(instID string) (*Instance, error) {
+	inst, ok := p.Instances[instID]
+	if !ok {
+		return nil, errors.New("instance not found")
+	}
+	return inst, nil
+}
+
+// Replace an instance by a new one, phasing it out once the new one is ready
+func (p *AppProxy) RestartInstance(instID string) error {
+	p.Lock()
+	defer p.Unlock()
+	inst, err := p.getInstance(instID)
+	if err != nil {
+		return err
+	}
+	inst.MarkOutdated()
+	go p.Rescale()
+	return nil
+}
+
+// Stop sending new users to an instance and stop it when its users have left
+func (p *AppProxy) PhaseOutInstance(instID string) error {
+	p.Lock()
+	defer p.Unlock()
+	inst, err := p.getInstance(instID)
+	if err != nil {
+		return err
+	}
+	if inst.Down() {
+		return errors.New("instance is not running")
+	}
+	inst.PhaseOut()
+	go p.Rescale()
+	return nil
+}
+
+// Stop an instance immediately, closing its sessions; a new instance is started if needed
+func (p *AppProxy) KillInstance(instID string) error {
+	p.Lock()
+	defer p.Unlock()
+	inst, err := p.getInstance(instID)
+	if err != nil {
+		return err
+	}
+	err = inst.Stop()
+	if err != nil {
+		return err
+	}
+	delete(p.Instances, inst.ID)
+	for id, sess := range p.Sessions {
+		if sess.Instance == inst {
+			p.doCloseSession(id)
+		}
+	}
+	go p.Rescale()
+	return nil
+}
+
+// Restart all instances of the app
+func (p *AppProxy) Restart() {
+	p.Lock()
+	defer p.Unlock()
+	p.phaseOut()
+}
+
+// Restart the instances which failed because of repeated crashes
+func (p *AppProxy) Retry() error {
+	p.Lock()
+	defer func() {
+		p.Unlock()
+		go p.ReportStatus()
+	}()
+	retried := false
+	for _, inst := range p.Instances {
+		if inst.Status() == instStatus.FAILED {
+			inst.Retry()
+			retried = true
+		}
+	}
+	if !retried {
+		return errors.New("no failed instance to restart")
+	}
+	return nil
 }
 
 // Remove an instance which has been stopped
@@ -250,49 +743,106 @@ func (p *AppProxy) DeleteInstance(ID string) {
 
 // Return app status info as a map
 func (app *AppProxy) GetStatus(detailed bool) map[string]interface{} {
+	app.RLock()
+	defer app.RUnlock()
 	nbRunning := 0
 	nbPhasingOut := 0
+	nbFailed := 0
 	userCount := 0
-	stdErr := []string{}
+	logs := []map[string]string{}
+	instances := []map[string]interface{}{}
 	for _, i := range app.Instances {
 		status := i.Status()
 		if status == instStatus.RUNNING {
 			nbRunning++
 		} else if status == instStatus.PHASING_OUT {
 			nbPhasingOut++
+		} else if status == instStatus.FAILED {
+			nbFailed++
 		}
 		if detailed {
-			stdErr = append(stdErr, i.StdErr())
+			logs = append(logs, map[string]string{"ID": i.ID, "Output": i.StdErr(), "KillReason": i.KillReason()})
+			instances = append(instances, i.Info())
 		}
 		userCount += i.UserCount()
 	}
 	status := map[string]interface{}{
 		"RunningInst":    nbRunning,
 		"PhasingOutInst": nbPhasingOut,
+		"FailedInst":     nbFailed,
 		"ConnectedUsers": userCount,
+		"QueuedUsers":    len(app.queue),
 	}
 	if detailed {
-		status["StdErr"] = stdErr
+		status["Logs"] = logs
+		sort.Slice(instances, func(i int, j int) bool {
+			return instances[i]["ID"].(string) < instances[j]["ID"].(string)
+		})
+		status["Instances"] = instances
 	}
 	return status
 }
 
+// Get the number of users connected to the app, updated from the activity of sessions
+func (p *AppProxy) ConnectedUsers() int {
+	p.Lock()
+	defer p.Unlock()
+	p.countUsers()
+	userCount := 0
+	for _, i := range p.Instances {
+		userCount += i.UserCount()
+	}
+	return userCount
+}
+
+// Check whether all instances of the app are stopped
+func (p *AppProxy) Stopped() bool {
+	p.RLock()
+	defer p.RUnlock()
+	for _, i := range p.Instances {
+		if status := i.Status(); status != instStatus.STOPPED && status != instStatus.ERROR {
+			return false
+		}
+	}
+	return true
+}
+
+// Notify administrators that the app is about to be stopped; users are notified by the
+// notice events stream
+func (p *AppProxy) ReportShutdown() {
+	msgData, _ := json.Marshal(map[string]string{
+		"appName": p.App.Name,
+		"value":   "shutting down",
+	})
+	p.StatusStream.Message <- string(msgData)
+}
+
 // Stream status update
 func (p *AppProxy) ReportStatus() {
 	p.RLock()
 	defer p.RUnlock()
 	userCount := 0
+	failed := false
 	for _, i := range p.Instances {
 		userCount += i.UserCount()
+		failed = failed || i.Status() == instStatus.FAILED
 	}
 	msg := ""
-	if userCount == 0 {
+	if p.upstream() != nil {
+		msg = "external upstream"
+	} else if userCount == 0 {
 		msg = "no connected user"
 	} else if userCount == 1 {
 		msg = "1 connected user"
 	} else {
 		msg = fmt.Sprintf("%d connected users", userCount)
 	}
+	if len(p.queue) > 0 {
+		msg += fmt.Sprintf(", %d waiting", len(p.queue))
+	}
+	if failed {
+		msg = "failed (crash loop), " + msg
+	}
 	msgData, _ := json.Marshal(map[string]string{
 		"appName": p.App.Name,
 		"value":   msg,
@@ -0,0 +1,204 @@
+package appserver
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/modules/appsource"
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Assign new sessions to an instance of an app proxy
+func addSessions(p *AppProxy, inst *Instance, n int) {
+	for i := 0; i < n; i++ {
+		sess := NewSession(p, "")
+		sess.Instance = inst
+		p.Sessions[sess.ID] = sess
+	}
+}
+
+// Get the IDs of the instances of an app proxy with a given status, or new ones if the ID is empty
+func instanceIDs(p *AppProxy, status string, known map[string]bool) string {
+	ids := []string{}
+	for id, inst := range p.Instances {
+		if inst.Status() == status {
+			if !known[id] {
+				id = "new"
+			}
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestRescale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts processes")
+	}
+	tests := []struct {
+		name       string
+		strategy   string
+		ids        []string
+		setup      func(p *AppProxy)
+		starting   string // instances started by rescaling are "new"
+		running    string
+		phasingOut string
+	}{
+		{name: "min workers", ids: []string{}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 2
+			p.App.MaxWorkers = 4
+		}, starting: "new,new"},
+		{name: "users per worker", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 4
+			p.App.UsersPerWorker = 2
+			addSessions(p, p.Instances["a"], 5)
+		}, starting: "new,new", running: "a"},
+		{name: "max users per worker", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MaxWorkers = 4
+			p.App.MaxUsersPerWorker = 2
+			addSessions(p, p.Instances["a"], 3)
+		}, starting: "new", running: "a"},
+		{name: "max workers", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 2
+			p.App.UsersPerWorker = 1
+			addSessions(p, p.Instances["a"], 5)
+		}, starting: "new", running: "a"},
+		{name: "idle instances kept during cooldown", ids: []string{"a", "b", "c"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 3
+			p.lastScaleUp = time.Now()
+			addSessions(p, p.Instances["a"], 1)
+		}, running: "a,b,c"},
+		{name: "idle instances stopped after cooldown", ids: []string{"a", "b", "c"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 3
+			p.lastScaleUp = time.Now().Add(-time.Hour)
+			for _, inst := range p.Instances {
+				inst.idleSince = time.Now().Add(-time.Hour)
+			}
+			addSessions(p, p.Instances["a"], 1)
+		}, running: "a"},
+		{name: "above max workers", ids: []string{"a", "b"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 1
+			p.lastScaleUp = time.Now()
+			addSessions(p, p.Instances["a"], 1)
+			addSessions(p, p.Instances["b"], 2)
+		}, running: "b", phasingOut: "a"},
+		{name: "scaled to zero", ids: []string{}, setup: func(p *AppProxy) {
+			p.App.MaxWorkers = 2
+		}},
+		{name: "started on demand", ids: []string{}, setup: func(p *AppProxy) {
+			p.App.MaxWorkers = 2
+			p.lastDemand = time.Now()
+		}, starting: "new"},
+		{name: "started for queued visitors", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MaxWorkers = 2
+			p.App.MaxUsersPerWorker = 1
+			addSessions(p, p.Instances["a"], 1)
+			p.queue = []*queueEntry{{ticket: "t", lastSeen: time.Now()}}
+		}, starting: "new", running: "a"},
+		{name: "inactive app", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.IsActive = false
+		}},
+		{name: "dedicated", strategy: config.Strategies.DEDICATED, ids: []string{"a", "b"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.App.MaxWorkers = 4
+			p.lastScaleUp = time.Now()
+			addSessions(p, p.Instances["a"], 1)
+			addSessions(p, p.Instances["b"], 1)
+		}, starting: "new", running: "a,b"},
+		{name: "rollout waits for new instances", ids: []string{"a"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.Instances["a"].MarkOutdated()
+			addSessions(p, p.Instances["a"], 1)
+		}, starting: "new", running: "a"},
+		{name: "rollout phases out outdated instances", ids: []string{"a", "b"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.Instances["a"].MarkOutdated()
+			addSessions(p, p.Instances["a"], 1)
+		}, running: "b", phasingOut: "a"},
+		{name: "rollout stops unused outdated instances", ids: []string{"a", "b"}, setup: func(p *AppProxy) {
+			p.App.MinWorkers = 1
+			p.Instances["a"].MarkOutdated()
+		}, running: "b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, conf := testCommandApp(t, "http")
+			conf.ints["scaling.cooldown"] = 300
+			strategy := test.strategy
+			if strategy == "" {
+				strategy = config.Strategies.LEAST_USERS
+			}
+			p := testAppProxy(strategy, test.ids...)
+			p.App.Name = app.Name
+			p.App.Runtime = app.Runtime
+			p.App.Command = app.Command
+			p.App.EnvVars = app.EnvVars
+			p.App.IsActive = true
+			p.App.MaxWorkers = 0
+			p.AppSource = &appsource.AppSourceDir{AppDir: t.TempDir()}
+			p.config = conf
+			known := map[string]bool{}
+			for _, inst := range p.Instances {
+				inst.config = conf
+				known[inst.ID] = true
+			}
+			p.done = make(chan struct{})
+			defer func() {
+				// background rescaling is stopped before the instances
+				close(p.done)
+				p.Lock()
+				defer p.Unlock()
+				for _, inst := range p.Instances {
+					inst.Stop()
+				}
+			}()
+			test.setup(p)
+
+			p.Rescale()
+
+			p.RLock()
+			defer p.RUnlock()
+			if got := instanceIDs(p, instStatus.STARTING, known); got != test.starting {
+				t.Errorf("expected starting instances %q, got %q", test.starting, got)
+			}
+			if got := instanceIDs(p, instStatus.RUNNING, known); got != test.running {
+				t.Errorf("expected running instances %q, got %q", test.running, got)
+			}
+			if got := instanceIDs(p, instStatus.PHASING_OUT, known); got != test.phasingOut {
+				t.Errorf("expected instances phasing out %q, got %q", test.phasingOut, got)
+			}
+		})
+	}
+}
+
+func TestRolloutDrain(t *testing.T) {
+	p := testAppProxy(config.Strategies.LEAST_USERS, "a", "b")
+	p.App.MinWorkers = 1
+	p.App.IsActive = true
+	p.App.MaxDrainTime = 1
+	p.config.(*MockConfig).ints["sessions.idletimeout"] = 60
+	p.done = make(chan struct{})
+	defer close(p.done)
+	p.Instances["a"].MarkOutdated()
+	addSessions(p, p.Instances["a"], 1)
+
+	p.Rescale()
+	if p.Instances["a"].Status() != instStatus.PHASING_OUT {
+		t.Fatalf("expected the outdated instance to be phased out")
+	}
+	// users are left to finish their session until the maximum drain time
+	p.Instances["a"].phasedOutAt = time.Now().Add(-2 * time.Minute)
+	p.Rescale()
+	if _, ok := p.Instances["a"]; ok || len(p.Sessions) != 0 {
+		t.Errorf("expected the outdated instance and its sessions to be closed after the drain time")
+	}
+}
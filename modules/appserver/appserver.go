@@ -5,8 +5,10 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/applog"
 	"github.com/appservR/appservR/modules/config"
 	"github.com/appservR/appservR/modules/ssehandler"
 )
@@ -14,10 +16,12 @@ import (
 // A struct to store all running apps objects
 type AppServer struct {
 	sync.RWMutex
-	broker     *ssehandler.MessageBroker
-	config     config.Config
-	appsByName map[string]*AppProxy
-	byPath     []*AppProxy
+	broker       *ssehandler.MessageBroker
+	config       config.Config
+	appsByName   map[string]*AppProxy
+	byPath       []*AppProxy
+	shuttingDown bool
+	draining     chan struct{} // closed when the server starts shutting down, to notify users
 }
 
 // Create a new struct to hold running app proxies
@@ -26,6 +30,7 @@ func NewAppServer(appModel models.AppModel, msgBroker *ssehandler.MessageBroker,
 		broker:     msgBroker,
 		appsByName: make(map[string]*AppProxy),
 		config:     config,
+		draining:   make(chan struct{}),
 	}
 	apps, err := appModel.All()
 	if err != nil {
@@ -44,31 +49,37 @@ func NewAppServer(appModel models.AppModel, msgBroker *ssehandler.MessageBroker,
 	return appServer, nil
 }
 
-// Apply app settings changes
+// Apply app settings changes; the app source is prepared without lock, as it may be
+// downloaded, so that other apps keep serving requests meanwhile
 func (s *AppServer) Update(appName string, app models.App) error {
-	s.Lock()
-	defer s.Unlock()
-	appProxy, ok := s.appsByName[appName]
-	if !ok {
+	appProxy, err := s.getApp(appName)
+	if err != nil {
 		// new app
 		appProxy, err := NewAppProxy(app, s.broker, s.config)
 		if err != nil {
 			return err
 		}
+		s.Lock()
+		defer s.Unlock()
+		if _, ok := s.appsByName[app.Name]; ok {
+			appProxy.Stop()
+			return errors.New("app already exists")
+		}
 		s.appsByName[app.Name] = appProxy
 		s.byPath = append(s.byPath, appProxy)
 		sort.SliceStable(s.byPath, s.prefixSort)
-	} else {
-		// updated app
-		prevApp := appProxy.App
-		appProxy.Update(app)
+		return nil
+	}
+	// updated app
+	prevApp := appProxy.Update(app)
+	if app.Name != prevApp.Name || app.Path != prevApp.Path {
+		s.Lock()
+		defer s.Unlock()
 		if app.Name != prevApp.Name {
 			delete(s.appsByName, prevApp.Name)
 			s.appsByName[app.Name] = appProxy
 		}
-		if app.Path != prevApp.Path {
-			sort.SliceStable(s.byPath, s.prefixSort)
-		}
+		sort.SliceStable(s.byPath, s.prefixSort)
 	}
 	return nil
 }
@@ -90,6 +101,167 @@ func (s *AppServer) Delete(appName string) error {
 	return nil
 }
 
+// Check whether the server is shutting down and no new session should be started
+func (s *AppServer) ShuttingDown() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.shuttingDown
+}
+
+// Stop starting new sessions, notify connected users and wait for them to leave until the
+// drain period ends
+func (s *AppServer) Drain(drain time.Duration) {
+	s.Lock()
+	if !s.shuttingDown {
+		close(s.draining)
+	}
+	s.shuttingDown = true
+	apps := s.apps()
+	s.Unlock()
+
+	for _, app := range apps {
+		app.ReportShutdown()
+	}
+	deadline := time.Now().Add(drain)
+	for time.Now().Before(deadline) {
+		users := 0
+		for _, app := range apps {
+			users += app.ConnectedUsers()
+		}
+		if users == 0 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Stop all instances and wait for their processes to exit until the timeout; app sources
+// are kept on disk for the next start
+func (s *AppServer) Shutdown(timeout time.Duration) {
+	logger := s.config.Logger()
+	s.Lock()
+	if !s.shuttingDown {
+		close(s.draining)
+	}
+	s.shuttingDown = true
+	apps := s.apps()
+	s.Unlock()
+
+	logger.Warning("stopping all app instances")
+	for _, app := range apps {
+		app.Stop()
+	}
+	deadline := time.Now().Add(timeout)
+	for _, app := range apps {
+		for !app.Stopped() {
+			if time.Now().After(deadline) {
+				logger.Warning("some instances of app " + app.App.Name + " did not stop before timeout")
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// List all app proxies without lock
+func (s *AppServer) apps() []*AppProxy {
+	apps := make([]*AppProxy, 0, len(s.appsByName))
+	for _, app := range s.appsByName {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// Get a running app proxy by app name
+func (s *AppServer) getApp(appName string) (*AppProxy, error) {
+	s.RLock()
+	defer s.RUnlock()
+	app, ok := s.appsByName[appName]
+	if !ok {
+		return nil, errors.New("app not found")
+	}
+	return app, nil
+}
+
+// Fetch the latest version of an app and restart it
+func (s *AppServer) Redeploy(appName string) error {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return err
+	}
+	return app.Redeploy()
+}
+
+// Switch an app to a previous revision of its source and restart it
+func (s *AppServer) Checkout(appName string, revision string) error {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return err
+	}
+	return app.Checkout(revision)
+}
+
+// Restart all instances of an app
+func (s *AppServer) Restart(appName string) error {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return err
+	}
+	app.Restart()
+	return nil
+}
+
+// Restart, phase out or kill a specific instance of an app
+func (s *AppServer) InstanceAction(appName string, instID string, action string) error {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "restart":
+		return app.RestartInstance(instID)
+	case "phaseout":
+		return app.PhaseOutInstance(instID)
+	case "kill":
+		return app.KillInstance(instID)
+	default:
+		return errors.New("unknown action: " + action)
+	}
+}
+
+// Restart the failed instances of an app
+func (s *AppServer) Retry(appName string) error {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return err
+	}
+	return app.Retry()
+}
+
+// Get the current revision of an app source
+func (s *AppServer) Revision(appName string) (string, error) {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return "", err
+	}
+	return app.Revision(), nil
+}
+
+// Get the console output log of an app instance
+func (s *AppServer) InstanceLog(appName string, instID string) (*applog.InstanceLog, error) {
+	app, err := s.getApp(appName)
+	if err != nil {
+		return nil, err
+	}
+	app.RLock()
+	defer app.RUnlock()
+	inst, ok := app.Instances[instID]
+	if !ok {
+		return nil, errors.New("instance not found")
+	}
+	return inst.Log(), nil
+}
+
 // Returns the status of all apps as a map indexed with app names
 func (s *AppServer) GetAllStatus() map[string]interface{} {
 	status := map[string]interface{}{}
@@ -101,17 +273,17 @@ func (s *AppServer) GetAllStatus() map[string]interface{} {
 
 // Returns the status of a given app
 func (s *AppServer) GetStatus(appName string) (map[string]interface{}, error) {
-	app, ok := s.appsByName[appName]
-	if !ok {
-		return nil, errors.New("app not found")
+	app, err := s.getApp(appName)
+	if err != nil {
+		return nil, err
 	}
 	return app.GetStatus(true), nil
 }
 
-// A comparison function for AppServer structs based on app path prefixing one another
+// A comparison function for AppServer structs putting longest app paths first, so that
+// nested apps are matched before the apps they are nested in
 func (s *AppServer) prefixSort(i, j int) bool {
-	return !strings.HasPrefix(s.byPath[i].App.Path,
-		s.byPath[j].App.Path)
+	return len(strings.TrimSuffix(s.byPath[i].App.Path, "/")) > len(strings.TrimSuffix(s.byPath[j].App.Path, "/"))
 }
 
 // Find a specific app proxy in a slice
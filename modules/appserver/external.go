@@ -0,0 +1,55 @@
+package appserver
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/appservR/appservR/modules/appsource"
+)
+
+// Cookies set by appservR, which are not passed on to external upstreams
+var privateCookies = map[string]bool{
+	"token":            true,
+	"appservr_session": true,
+	"appservr_queue":   true,
+}
+
+// Get the URL requests are forwarded to if the app runs outside of appservR, or nil
+func (p *AppProxy) Upstream() *url.URL {
+	p.RLock()
+	defer p.RUnlock()
+	return p.upstream()
+}
+
+// Get the upstream URL of an external app without lock
+func (p *AppProxy) upstream() *url.URL {
+	if source, ok := p.AppSource.(*appsource.AppSourceExternal); ok && source.Error() == nil {
+		return source.URL()
+	}
+	return nil
+}
+
+// Remove appservR credentials from a request forwarded to an external upstream, so that
+// they cannot be replayed by a third party
+func stripCredentials(req *http.Request) {
+	req.Header.Del("Authorization")
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !privateCookies[cookie.Name] {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// Stop all instances and close their sessions
+func (p *AppProxy) stopInstances() {
+	for id, inst := range p.Instances {
+		inst.Stop()
+		delete(p.Instances, id)
+	}
+	for id := range p.Sessions {
+		delete(p.Sessions, id)
+	}
+	p.queue = nil
+}
@@ -0,0 +1,37 @@
+package appserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripCredentials(t *testing.T) {
+	req := httptest.NewRequest("GET", "/ext/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "token=jwt; theme=dark; appservr_session=s1; appservr_queue=q1; other=1")
+
+	stripCredentials(req)
+
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("Authorization header was forwarded")
+	}
+	got := map[string]string{}
+	for _, cookie := range req.Cookies() {
+		got[cookie.Name] = cookie.Value
+	}
+	for _, name := range []string{"token", "appservr_session", "appservr_queue"} {
+		if _, ok := got[name]; ok {
+			t.Errorf("cookie %s was forwarded", name)
+		}
+	}
+	if got["theme"] != "dark" || got["other"] != "1" {
+		t.Errorf("expected other cookies to be kept, got %v", got)
+	}
+
+	req = httptest.NewRequest("GET", "/ext/", nil)
+	stripCredentials(req)
+	if _, ok := req.Header[http.CanonicalHeaderKey("Cookie")]; ok {
+		t.Errorf("expected no cookie header")
+	}
+}
@@ -3,15 +3,21 @@ package appserver
 import (
 	"bufio"
 	"errors"
-	"io"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/applog"
+	"github.com/appservR/appservR/modules/appruntime"
 	"github.com/appservR/appservR/modules/config"
 	"github.com/appservR/appservR/modules/portspool"
+	"github.com/appservR/appservR/modules/rinstall"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -20,12 +26,32 @@ type Instance struct {
 	ID           string
 	appName      string
 	appDir       string
+	runtime      appruntime.AppRuntime
+	rInstall     string
+	env          []string
+	runAsUser    string
+	runAsGroup   string
+	limits       Limits
+	cgroup       string
+	startedAt    time.Time
+	killReason   string
+	limitKilled  bool // killed by the watchdog, which does not count as a crash
+	stopped      bool
+	onChange     func() // called when the instance becomes ready or fails
 	status       string
 	port         string
-	stdErr       string
+	log          *applog.InstanceLog
 	cmd          *exec.Cmd
 	userCount    int
+	idleSince    time.Time
+	phasedOutAt  time.Time
+	outdated     bool
 	restartDelay int
+	crashes      []time.Time
+	restarts     int
+	cpuTime      time.Duration // cpu time used by the instance processes at the last sample
+	cpuSampledAt time.Time
+	cpuLoad      float64
 	config       config.Config
 }
 
@@ -36,6 +62,7 @@ var instStatus = struct {
 	STOPPING    string
 	ERROR       string
 	STOPPED     string
+	FAILED      string
 }{
 	STARTING:    "STARTING",
 	RUNNING:     "RUNNING",
@@ -43,16 +70,37 @@ var instStatus = struct {
 	STOPPING:    "STOPPING",
 	ERROR:       "ERROR",
 	STOPPED:     "STOPPED",
+	FAILED:      "FAILED",
 }
 
-// Create a new instance of the app
-func NewInstance(appName string, appDir string, conf config.Config) *Instance {
+// Create a new instance of the app, running the source files in appDir
+func NewInstance(app models.App, appDir string, conf config.Config) *Instance {
+	appName := app.Name
+	id := uuid.NewV4().String()[0:6]
+	// console output is logged to files in a folder per app, deleting old files
+	logDir := filepath.Join(conf.ExecutableFolder(), "logs", appName)
+	if keepDays := conf.GetInt("logs.keepdays"); keepDays > 0 {
+		applog.Prune(logDir, time.Duration(keepDays)*24*time.Hour)
+	}
+	log, err := applog.NewInstanceLog(filepath.Join(logDir, id+".log"),
+		int64(conf.GetInt("logs.maxsize"))*1024*1024, conf.GetInt("logs.maxfiles"), conf.GetInt("logs.bufferlines"))
+	if err != nil {
+		conf.Logger().Warning(err.Error())
+	}
 	return &Instance{
-		ID:      uuid.NewV4().String()[0:6],
-		appName: appName,
-		appDir:  appDir,
-		config:  conf,
-		status:  instStatus.STOPPED,
+		ID:         id,
+		appName:    appName,
+		appDir:     appDir,
+		runtime:    appruntime.NewAppRuntime(app),
+		rInstall:   app.RInstallation,
+		env:        app.Environ(),
+		runAsUser:  app.RunAsUser,
+		runAsGroup: app.RunAsGroup,
+		limits:     appLimits(app),
+		log:        log,
+		config:     conf,
+		status:     instStatus.STOPPED,
+		idleSince:  time.Now(),
 	}
 }
 
@@ -63,6 +111,11 @@ func (inst *Instance) Status() string {
 	return inst.status
 }
 
+// Get the folder of the app source files run by the instance
+func (inst *Instance) AppDir() string {
+	return inst.appDir
+}
+
 // Get instance port
 func (inst *Instance) Port() string {
 	inst.RLock()
@@ -77,99 +130,303 @@ func (inst *Instance) UserCount() int {
 	return inst.userCount
 }
 
-// Get instance console output
-func (inst *Instance) StdErr() string {
+// Get the duration since the last user disconnected (zero if users are connected)
+func (inst *Instance) IdleTime() time.Duration {
 	inst.RLock()
 	defer inst.RUnlock()
-	return inst.stdErr
+	if inst.userCount > 0 {
+		return 0
+	}
+	return time.Since(inst.idleSince)
+}
+
+// Get the last lines of instance console output
+func (inst *Instance) StdErr() string {
+	return inst.log.String()
+}
+
+// Get instance console output log
+func (inst *Instance) Log() *applog.InstanceLog {
+	return inst.log
+}
+
+// Check that instances can be run as a given user and group
+func CheckRunAs(username string, groupname string) error {
+	if username == "" {
+		if groupname != "" {
+			return errors.New("a group can only be set with a user")
+		}
+		return nil
+	}
+	return checkRunAs(username, groupname)
+}
+
+// Variables of the service environment needed to run R, passed to all app instances
+var baseEnvVars = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "SHELL": true, "LANG": true, "LANGUAGE": true,
+	"TZ": true, "TMPDIR": true, "TEMP": true, "TMP": true,
+	// Windows system variables
+	"SYSTEMROOT": true, "SYSTEMDRIVE": true, "WINDIR": true, "COMSPEC": true, "PATHEXT": true,
+	"USERNAME": true, "USERPROFILE": true, "HOMEDRIVE": true, "HOMEPATH": true, "APPDATA": true,
+	"LOCALAPPDATA": true, "PROGRAMDATA": true, "PROGRAMFILES": true, "NUMBER_OF_PROCESSORS": true,
+	"PROCESSOR_ARCHITECTURE": true,
+}
+
+// Get the part of the service environment passed to app instances: system, locale and R
+// variables, and the variables listed in the apps.passenv setting, so that secrets of
+// the service are not exposed to apps
+func baseEnviron(conf config.Config) []string {
+	passEnv := map[string]bool{}
+	for _, name := range conf.GetStringSlice("apps.passenv") {
+		passEnv[strings.ToUpper(name)] = true
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		name := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		if baseEnvVars[name] || passEnv[name] || strings.HasPrefix(name, "LC_") || strings.HasPrefix(name, "R_") {
+			env = append(env, kv)
+		}
+	}
+	return env
 }
 
 // Start an instance of the app and relaunch when it fails
 func (inst *Instance) Start() error {
 	inst.Lock()
 	defer inst.Unlock()
+	if inst.stopped {
+		return errors.New("instance has been stopped")
+	}
 	logger := inst.config.Logger()
+	inst.startedAt = time.Now()
+	inst.cpuSampledAt = time.Time{}
+	// failures to start the process are handled like crashes
+	fail := func(err error) error {
+		inst.cmd = nil
+		inst.status = instStatus.ERROR
+		inst.log.WriteLine(err.Error())
+		inst.restart(true)
+		return err
+	}
 	port, err := portspool.GetNext()
 	if err != nil {
-		return err
+		return fail(err)
 	}
 	inst.port = port
 	_, err = os.Stat(inst.appDir)
 	if err != nil {
-		inst.status = instStatus.ERROR
-		inst.stdErr = "App source directory does not exist"
-		return errors.New("app source directory does not exist")
+		return fail(errors.New("app source directory does not exist"))
+	}
+	var args []string
+	rscript, err := rinstall.Path(inst.config, inst.rInstall)
+	if err == nil {
+		args, err = inst.runtime.Command(inst.appDir, rscript, inst.port)
+	}
+	if err != nil {
+		return fail(err)
 	}
 	inst.status = instStatus.STARTING
-	cmd := exec.Command(inst.config.GetString("Rscript"), "-e", "shiny::runApp('.', port="+inst.port+")")
+	cmd := exec.Command(args[0], args[1:]...)
 	inst.cmd = cmd
 	cmd = configCmd(cmd)
 	cmd.Dir = inst.appDir
-	cmd.Env = os.Environ()
-	stdOut, err := cmd.StdoutPipe()
+	// app specific variables take precedence over the service environment
+	cmd.Env = append(baseEnviron(inst.config), inst.env...)
+	if inst.runAsUser != "" {
+		err = runAs(cmd, inst.runAsUser, inst.runAsGroup, filepath.Join(inst.config.ExecutableFolder(), "home", inst.appName),
+			filepath.Join(inst.config.ExecutableFolder(), "apps"))
+		if err != nil {
+			return fail(err)
+		}
+	}
+	// stdout and stderr share the same pipe to keep lines in order; the pipe is read until
+	// all processes writing to it exit, independently of cmd.Wait
+	outReader, outWriter, err := os.Pipe()
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	stdErr, err := cmd.StderrPipe()
+	cmd.Stdout = outWriter
+	cmd.Stderr = outWriter
+
+	// Actually starting the subprocess
+	logger.Info("starting app " + inst.appName + " (" + inst.ID + ")")
+	inst.log.WriteLine("[appservR] starting instance " + inst.ID + " on port " + inst.port)
+	inst.cgroup, err = startLimited(cmd, inst.limits, inst.appName+"-"+inst.ID, inst.config)
+	outWriter.Close()
 	if err != nil {
-		return err
+		outReader.Close()
+		return fail(err)
 	}
-	// Goroutine to read output and save stderr
+
+	// Goroutine to save console output
 	go func() {
-		merged := io.MultiReader(stdErr, stdOut)
-		scanner := bufio.NewScanner(merged)
+		defer outReader.Close()
+		scanner := bufio.NewScanner(outReader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 		for scanner.Scan() {
-			line := scanner.Text()
-			inst.Lock()
-			inst.stdErr += line + "\n"
-			if strings.HasPrefix(line, "Listening on") {
-				inst.status = instStatus.RUNNING
-				logger.Info("app " + inst.appName + " at " + inst.port + " is running (" + inst.ID + ")")
-				inst.Unlock()
-				return
-			}
-			inst.Unlock()
+			inst.log.WriteLine(scanner.Text())
 		}
 	}()
 
-	// Actually starting the subprocess
-	logger.Info("starting app " + inst.appName + " (" + inst.ID + ")")
-	if err = cmd.Start(); err != nil {
-		return err
-	}
+	// Goroutine to check when the instance is ready and whether it stays alive
+	exited := make(chan struct{})
+	go inst.probe(cmd, exited)
+
+	// Goroutine to kill the instance when it exceeds its resource limits
+	go inst.watchdog(cmd, exited, inst.startedAt)
 
 	// Goroutine to restart the instance on stop
 	go func() {
 		err := cmd.Wait()
+		close(exited)
 		inst.Lock()
 		defer inst.Unlock()
+		releaseLimits(inst.cgroup, inst.config)
+		inst.cgroup = ""
 		if inst.status == instStatus.STOPPING {
 			logger.Info(inst.appName + " instance stopped (" + inst.ID + ")")
 			inst.status = instStatus.STOPPED
+			inst.log.Close()
 		} else {
 			if err != nil {
 				logger.Info(inst.appName + " instance exited with error (" + inst.ID + ")")
 				logger.Info(err.Error())
+				inst.log.WriteLine("[appservR] instance exited with error: " + err.Error())
 				inst.status = instStatus.ERROR
 			} else {
 				logger.Info(inst.appName + " instance exited successfully (" + inst.ID + ")")
 				inst.status = instStatus.STOPPED
 			}
-			inst.restartDelay = inst.restartDelay*2 + 1
-			time.AfterFunc(time.Duration(inst.restartDelay)*time.Second, func() { inst.Start() })
+			inst.restart(!inst.limitKilled)
+			inst.limitKilled = false
 		}
 	}()
 
 	return nil
 }
 
+// Schedule a restart of an instance which exited unexpectedly, with an exponential backoff
+// reset after a healthy uptime; too many crashes in a short time mark the instance as failed.
+// Instances killed for exceeding their limits are restarted at once
+func (inst *Instance) restart(crashed bool) {
+	portspool.Release(inst.port)
+	if !crashed {
+		inst.restarts++
+		inst.restartDelay = 0
+		go inst.Start()
+		return
+	}
+	now := time.Now()
+	if now.Sub(inst.startedAt) >= time.Duration(inst.config.GetInt("restart.resetafter"))*time.Second {
+		inst.restartDelay = 0
+	}
+	window := time.Duration(inst.config.GetInt("restart.crashloop.window")) * time.Minute
+	crashes := []time.Time{now}
+	for _, t := range inst.crashes {
+		if now.Sub(t) < window {
+			crashes = append(crashes, t)
+		}
+	}
+	inst.crashes = crashes
+	if maxCrashes := inst.config.GetInt("restart.crashloop.count"); maxCrashes > 0 && len(crashes) >= maxCrashes {
+		inst.status = instStatus.FAILED
+		inst.log.WriteLine(fmt.Sprintf("[appservR] instance crashed %d times in %s, not restarting", len(crashes), window))
+		inst.config.Logger().Warning(inst.appName + " instance is crash looping, giving up restarting (" + inst.ID + ")")
+		if inst.onChange != nil {
+			go inst.onChange()
+		}
+		return
+	}
+	inst.restarts++
+	inst.restartDelay = inst.restartDelay*2 + 1
+	if maxDelay := inst.config.GetInt("restart.maxdelay"); maxDelay > 0 && inst.restartDelay > maxDelay {
+		inst.restartDelay = maxDelay
+	}
+	time.AfterFunc(time.Duration(inst.restartDelay)*time.Second, func() { inst.Start() })
+}
+
+// Restart an instance which failed because of repeated crashes
+func (inst *Instance) Retry() error {
+	inst.Lock()
+	if inst.status != instStatus.FAILED {
+		inst.Unlock()
+		return errors.New("instance has not failed")
+	}
+	inst.crashes = nil
+	inst.restartDelay = 0
+	inst.status = instStatus.STOPPED
+	inst.Unlock()
+	return inst.Start()
+}
+
+// Get the details of an instance as a map, directly usable in template
+func (inst *Instance) Info() map[string]interface{} {
+	inst.RLock()
+	defer inst.RUnlock()
+	info := map[string]interface{}{
+		"ID":       inst.ID,
+		"Port":     inst.port,
+		"PID":      "",
+		"Status":   inst.status,
+		"Uptime":   "",
+		"Users":    inst.userCount,
+		"Restarts": inst.restarts,
+		"Memory":   "",
+		"Outdated": inst.outdated,
+	}
+	switch inst.status {
+	case instStatus.STARTING, instStatus.RUNNING, instStatus.PHASING_OUT:
+		if inst.cmd != nil && inst.cmd.Process != nil {
+			info["PID"] = strconv.Itoa(inst.cmd.Process.Pid)
+			if rss, err := processMemory(inst.cmd.Process.Pid); err == nil {
+				info["Memory"] = fmt.Sprintf("%d MB", rss/1024/1024)
+			}
+		}
+		info["Uptime"] = time.Since(inst.startedAt).Round(time.Second).String()
+	}
+	return info
+}
+
+// Check whether the instance process is not running, waiting to be restarted or failed
+func (inst *Instance) Down() bool {
+	status := inst.Status()
+	return status == instStatus.ERROR || status == instStatus.STOPPED || status == instStatus.FAILED
+}
+
 // Mark an app instance as phasing out - not accepting new users before it can be stopped
 func (inst *Instance) PhaseOut() {
 	inst.Lock()
 	defer inst.Unlock()
+	if inst.status != instStatus.PHASING_OUT {
+		inst.phasedOutAt = time.Now()
+	}
 	inst.status = instStatus.PHASING_OUT
 }
 
+// Get the duration since the instance started phasing out
+func (inst *Instance) PhasingOutTime() time.Duration {
+	inst.RLock()
+	defer inst.RUnlock()
+	if inst.status != instStatus.PHASING_OUT {
+		return 0
+	}
+	return time.Since(inst.phasedOutAt)
+}
+
+// Mark an app instance as running an outdated version, to be replaced when new instances are ready
+func (inst *Instance) MarkOutdated() {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.outdated = true
+}
+
+// Check whether the instance runs an outdated version of the app
+func (inst *Instance) Outdated() bool {
+	inst.RLock()
+	defer inst.RUnlock()
+	return inst.outdated
+}
+
 // Stop an app instance
 func (inst *Instance) doStop() error {
 	if inst.cmd != nil {
@@ -177,6 +434,8 @@ func (inst *Instance) doStop() error {
 		if err != nil {
 			return err
 		}
+	} else {
+		inst.log.Close()
 	}
 	portspool.Release(inst.port)
 	return nil
@@ -186,6 +445,13 @@ func (inst *Instance) doStop() error {
 func (inst *Instance) Stop() error {
 	inst.Lock()
 	defer inst.Unlock()
+	inst.stopped = true
+	// the process already exited and is waiting to be restarted or failed
+	if inst.status == instStatus.ERROR || inst.status == instStatus.STOPPED || inst.status == instStatus.FAILED {
+		inst.status = instStatus.STOPPED
+		inst.log.Close()
+		return nil
+	}
 	inst.status = instStatus.STOPPING
 	return inst.doStop()
 }
@@ -202,4 +468,11 @@ func (inst *Instance) SetUserCount(incr int, relative bool) {
 	if inst.userCount < 0 {
 		inst.userCount = 0
 	}
+	if inst.userCount == 0 {
+		if inst.idleSince.IsZero() {
+			inst.idleSince = time.Now()
+		}
+	} else {
+		inst.idleSince = time.Time{}
+	}
 }
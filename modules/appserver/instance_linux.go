@@ -3,7 +3,16 @@
 package appserver
 
 import (
+	"errors"
+	"io/fs"
+	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -18,3 +27,154 @@ func configCmd(cmd *exec.Cmd) *exec.Cmd {
 func killCmd(cmd *exec.Cmd) error {
 	return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
 }
+
+// Get the uid and gid of a user and optional group
+func lookupCredential(username string, groupname string) (*syscall.Credential, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, errors.New("unknown user: " + username)
+	}
+	gid := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return nil, errors.New("unknown group: " + groupname)
+		}
+		gid = g.Gid
+	}
+	uidNum, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gidNum, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uidNum), Gid: uint32(gidNum), Groups: []uint32{}}, nil
+}
+
+// Check that a user and optional group exist
+func checkRunAs(username string, groupname string) error {
+	_, err := lookupCredential(username, groupname)
+	return err
+}
+
+// Configure cmd to run as another user on Linux, with a private home and temporary directory;
+// app sources managed by appservR in sourcesDir are made readable by the group of the user
+func runAs(cmd *exec.Cmd, username string, groupname string, privateDir string, sourcesDir string) error {
+	cred, err := lookupCredential(username, groupname)
+	if err != nil {
+		return err
+	}
+	// the parent directory is shared by the apps, which can only access their own home
+	err = os.MkdirAll(filepath.Dir(privateDir), 0755)
+	if err == nil {
+		err = os.Chmod(filepath.Dir(privateDir), 0755)
+	}
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(privateDir, "tmp")
+	err = os.MkdirAll(tmpDir, 0700)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{privateDir, tmpDir} {
+		err = os.Chown(dir, int(cred.Uid), int(cred.Gid))
+		if err == nil {
+			err = os.Chmod(dir, 0700)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = shareSource(cmd.Dir, sourcesDir, int(cred.Gid))
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential = cred
+	cmd.Env = append(cmd.Env, "HOME="+privateDir, "USER="+username, "LOGNAME="+username,
+		"TMPDIR="+tmpDir, "TMP="+tmpDir, "TEMP="+tmpDir)
+	return nil
+}
+
+// App source folders already shared with a group, so that the whole tree is only walked
+// once per deployment rather than on every instance start
+var sharedSources = struct {
+	sync.Mutex
+	dirs map[string]sharedSource
+}{dirs: map[string]sharedSource{}}
+
+type sharedSource struct {
+	info os.FileInfo // to detect a folder deleted and created again, e.g. for the same revision, or changed
+	gid  int
+}
+
+// Give a group read access to an app source extracted or cloned by appservR, which is only
+// accessible to the service user; directories leading to it can be traversed but not listed
+func shareSource(appDir string, sourcesDir string, gid int) error {
+	appDir, err := filepath.Abs(appDir)
+	if err != nil {
+		return err
+	}
+	sourcesDir, err = filepath.Abs(sourcesDir)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(appDir, sourcesDir+string(os.PathSeparator)) {
+		return nil
+	}
+	info, err := os.Stat(appDir)
+	if err != nil {
+		return err
+	}
+	sharedSources.Lock()
+	shared, ok := sharedSources.dirs[appDir]
+	sharedSources.Unlock()
+	if ok && shared.gid == gid && os.SameFile(shared.info, info) && shared.info.ModTime().Equal(info.ModTime()) {
+		return nil
+	}
+	err = shareTree(appDir, sourcesDir, gid)
+	if err != nil {
+		return err
+	}
+	sharedSources.Lock()
+	sharedSources.dirs[appDir] = sharedSource{info: info, gid: gid}
+	sharedSources.Unlock()
+	return nil
+}
+
+// Give a group read access to all files of a folder in sourcesDir
+func shareTree(appDir string, sourcesDir string, gid int) error {
+	for dir := filepath.Dir(appDir); strings.HasPrefix(dir, sourcesDir); dir = filepath.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(dir, fi.Mode().Perm()|0711)
+		if err != nil {
+			return err
+		}
+	}
+	return filepath.WalkDir(appDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode().Perm() | 0040
+		if d.IsDir() {
+			mode |= 0010
+		}
+		err = os.Lchown(path, -1, gid)
+		if err == nil {
+			err = os.Chmod(path, mode)
+		}
+		return err
+	})
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package appserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Get the permissions of a file
+func filePerm(t *testing.T, path string) os.FileMode {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Mode().Perm()
+}
+
+func TestShareSource(t *testing.T) {
+	sourcesDir := t.TempDir()
+	appDir := filepath.Join(sourcesDir, "bundles", "app", "rev")
+	write := func(name string) string {
+		path := filepath.Join(appDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("# app"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gid := os.Getgid()
+
+	app := write("app.R")
+	write("data/data.csv")
+	if err := shareSource(appDir, sourcesDir, gid); err != nil {
+		t.Fatal(err)
+	}
+	if filePerm(t, app) != 0640 || filePerm(t, appDir) != 0750 || filePerm(t, filepath.Dir(appDir)) != 0711 {
+		t.Errorf("expected the app source to be readable by the group")
+	}
+
+	// the tree is not walked again for the same deployment
+	added := write("data/added.csv")
+	if err := shareSource(appDir, sourcesDir, gid); err != nil {
+		t.Fatal(err)
+	}
+	if filePerm(t, added) != 0600 {
+		t.Errorf("expected the source not to be shared again")
+	}
+
+	// a folder created again is shared again
+	os.RemoveAll(appDir)
+	recreated := write("app.R")
+	if err := shareSource(appDir, sourcesDir, gid); err != nil {
+		t.Fatal(err)
+	}
+	if filePerm(t, recreated) != 0640 {
+		t.Errorf("expected the new folder to be shared")
+	}
+
+	// folders which are not managed by appservR are left unchanged
+	other := t.TempDir()
+	os.WriteFile(filepath.Join(other, "app.R"), []byte("# app"), 0600)
+	if err := shareSource(other, sourcesDir, gid); err != nil || filePerm(t, filepath.Join(other, "app.R")) != 0600 {
+		t.Errorf("expected folders outside of the sources folder not to be shared")
+	}
+}
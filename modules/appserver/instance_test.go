@@ -0,0 +1,243 @@
+package appserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/appruntime"
+	"github.com/appservR/appservR/modules/config"
+)
+
+func TestBaseEnviron(t *testing.T) {
+	conf := newMockConfig()
+	conf.slices["apps.passenv"] = []string{"http_proxy"}
+	for k, v := range map[string]string{
+		"APPSERVR_SECRET_KEY": "secret",
+		"DATABASE_PASSWORD":   "secret",
+		"R_LIBS_USER":         "/opt/R/library",
+		"LC_ALL":              "C.UTF-8",
+		"HTTP_PROXY":          "http://proxy:3128",
+	} {
+		t.Setenv(k, v)
+	}
+	env := map[string]string{}
+	for _, kv := range baseEnviron(conf) {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	for _, name := range []string{"APPSERVR_SECRET_KEY", "DATABASE_PASSWORD"} {
+		if _, ok := env[name]; ok {
+			t.Errorf("expected %s not to be passed to apps", name)
+		}
+	}
+	for _, name := range []string{"R_LIBS_USER", "LC_ALL", "HTTP_PROXY"} {
+		if env[name] != os.Getenv(name) {
+			t.Errorf("expected %s to be passed to apps", name)
+		}
+	}
+	if path, ok := env["PATH"]; !ok || path != os.Getenv("PATH") {
+		t.Errorf("expected PATH to be passed to apps")
+	}
+}
+
+// Run by tests as the process of an app instance, in the mode set by APPSERVR_TEST_INSTANCE:
+// serving HTTP, failing after the first request, crashing or never answering
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("APPSERVR_TEST_INSTANCE")
+	if mode == "" {
+		return
+	}
+	port := os.Args[len(os.Args)-1]
+	switch mode {
+	case "crash":
+		os.Exit(1)
+	case "silent":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	var requests int32
+	err := http.ListenAndServe("localhost:"+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 && mode == "unhealthy" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// Get the settings of an app running the test binary as instance process in a given mode,
+// and a config with short probe and restart delays
+func testCommandApp(t *testing.T, mode string) (models.App, *MockConfig) {
+	conf := newMockConfig()
+	conf.folder = t.TempDir()
+	conf.logger = config.NewLogger(4)
+	for k, v := range map[string]int{
+		"probe.timeout":            1,
+		"probe.readiness.interval": 1,
+		"probe.readiness.timeout":  10,
+		"probe.liveness.interval":  1,
+		"probe.liveness.failures":  1,
+		"restart.maxdelay":         60,
+		"restart.resetafter":       300,
+		"restart.crashloop.count":  2,
+		"restart.crashloop.window": 10,
+		"sessions.idletimeout":     60,
+		"logs.bufferlines":         100,
+	} {
+		conf.ints[k] = v
+	}
+	app := models.App{
+		Name:       "app",
+		Runtime:    appruntime.Runtimes.COMMAND,
+		Command:    `"` + os.Args[0] + `" -test.run=^TestHelperProcess$ -- {port}`,
+		EnvVars:    []models.AppEnvVar{{Name: "APPSERVR_TEST_INSTANCE", Value: mode}},
+		MaxWorkers: 1,
+		IsActive:   true,
+	}
+	return app, conf
+}
+
+// Wait until a condition is met or fail after a timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	conf := newMockConfig()
+	conf.logger = config.NewLogger(4)
+	conf.ints["restart.maxdelay"] = 5
+	conf.ints["restart.resetafter"] = 300
+	conf.ints["restart.crashloop.count"] = 5
+	conf.ints["restart.crashloop.window"] = 10
+	// a stopped instance is not actually started again by the scheduled restarts
+	inst := testInstance("a", instStatus.ERROR, conf)
+	inst.stopped = true
+
+	t.Run("backoff", func(t *testing.T) {
+		delays := []int{}
+		for i := 0; i < 4; i++ {
+			inst.startedAt = time.Now()
+			inst.restart(true)
+			delays = append(delays, inst.restartDelay)
+		}
+		if fmt.Sprint(delays) != "[1 3 5 5]" || inst.restarts != 4 || inst.Status() == instStatus.FAILED {
+			t.Errorf("expected exponential delays capped to the maximum, got %v", delays)
+		}
+	})
+
+	t.Run("reset after healthy uptime", func(t *testing.T) {
+		inst.crashes = nil
+		inst.startedAt = time.Now().Add(-10 * time.Minute)
+		inst.restart(true)
+		if inst.restartDelay != 1 {
+			t.Errorf("expected the delay to be reset, got %d", inst.restartDelay)
+		}
+	})
+
+	t.Run("limit killed", func(t *testing.T) {
+		crashes := len(inst.crashes)
+		inst.restart(false)
+		if inst.restartDelay != 0 || len(inst.crashes) != crashes {
+			t.Errorf("expected an immediate restart not counted as a crash")
+		}
+	})
+
+	t.Run("crash loop", func(t *testing.T) {
+		inst.crashes = []time.Time{time.Now().Add(-20 * time.Minute)}
+		for i := 0; i < 4; i++ {
+			inst.restart(true)
+		}
+		if inst.Status() == instStatus.FAILED {
+			t.Fatal("expected crashes outside of the window not to count")
+		}
+		inst.restart(true)
+		if inst.Status() != instStatus.FAILED {
+			t.Errorf("expected the instance to fail after repeated crashes, got %s", inst.Status())
+		}
+	})
+}
+
+func TestInstanceProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts processes")
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		app, conf := testCommandApp(t, "http")
+		inst := NewInstance(app, t.TempDir(), conf)
+		ready := make(chan struct{}, 1)
+		inst.onChange = func() { ready <- struct{}{} }
+		defer inst.Stop()
+		if err := inst.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status() != instStatus.STARTING {
+			t.Errorf("expected instance to be starting, got %s", inst.Status())
+		}
+		select {
+		case <-ready:
+		case <-time.After(10 * time.Second):
+			t.Fatal("instance not ready")
+		}
+		if inst.Status() != instStatus.RUNNING {
+			t.Errorf("expected instance to be running, got %s", inst.Status())
+		}
+	})
+
+	t.Run("liveness", func(t *testing.T) {
+		app, conf := testCommandApp(t, "unhealthy")
+		inst := NewInstance(app, t.TempDir(), conf)
+		defer inst.Stop()
+		inst.Start()
+		waitFor(t, 10*time.Second, "instance to be restarted", func() bool {
+			inst.RLock()
+			defer inst.RUnlock()
+			return inst.restarts > 0
+		})
+	})
+
+	t.Run("readiness timeout", func(t *testing.T) {
+		app, conf := testCommandApp(t, "silent")
+		conf.ints["probe.readiness.timeout"] = 1
+		inst := NewInstance(app, t.TempDir(), conf)
+		defer inst.Stop()
+		inst.Start()
+		waitFor(t, 10*time.Second, "instance to be killed", func() bool {
+			inst.RLock()
+			defer inst.RUnlock()
+			return inst.restarts > 0
+		})
+		if status := inst.Status(); status == instStatus.RUNNING {
+			t.Errorf("expected instance not to be running")
+		}
+	})
+
+	t.Run("crash loop", func(t *testing.T) {
+		app, conf := testCommandApp(t, "crash")
+		inst := NewInstance(app, t.TempDir(), conf)
+		defer inst.Stop()
+		inst.Start()
+		waitFor(t, 10*time.Second, "instance to fail", func() bool { return inst.Status() == instStatus.FAILED })
+		inst.RLock()
+		restarts := inst.restarts
+		inst.RUnlock()
+		if restarts != 1 {
+			t.Errorf("expected one restart before failing, got %d", restarts)
+		}
+		if err := inst.Retry(); err != nil {
+			t.Errorf("expected failed instance to be retried, got %v", err)
+		}
+	})
+}
@@ -3,10 +3,13 @@
 package appserver
 
 import (
+	"errors"
 	"os/exec"
 	"strconv"
 )
 
+var errRunAs = errors.New("running instances as another user is not supported on Windows")
+
 // noop on Windows
 func configCmd(cmd *exec.Cmd) *exec.Cmd {
 	return cmd
@@ -17,3 +20,13 @@ func killCmd(cmd *exec.Cmd) error {
 	kill := exec.Command("TASKKILL", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
 	return kill.Run()
 }
+
+// not supported on Windows
+func checkRunAs(username string, groupname string) error {
+	return errRunAs
+}
+
+// not supported on Windows
+func runAs(cmd *exec.Cmd, username string, groupname string, privateDir string, sourcesDir string) error {
+	return errRunAs
+}
@@ -0,0 +1,74 @@
+package appserver
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/appservR/appservR/models"
+)
+
+// Resource limits applied to the processes of an instance; zero values mean no limit
+type Limits struct {
+	Memory    int64         // resident memory in bytes
+	CPU       int           // percentage of one CPU core
+	OpenFiles uint64        // number of open files
+	WallTime  time.Duration // lifetime of the instance before it is restarted
+}
+
+// Get the resource limits set for an app
+func appLimits(app models.App) Limits {
+	return Limits{
+		Memory:    int64(app.MemoryLimit) * 1024 * 1024,
+		CPU:       app.CPULimit,
+		OpenFiles: uint64(app.OpenFilesLimit),
+		WallTime:  time.Duration(app.WallTimeLimit) * time.Minute,
+	}
+}
+
+// Get the reason why the instance was last killed for exceeding its limits
+func (inst *Instance) KillReason() string {
+	inst.RLock()
+	defer inst.RUnlock()
+	return inst.killReason
+}
+
+// Check periodically that the instance process started at startedAt stays within its memory
+// and wall time limits, and kill it otherwise so that it is restarted
+func (inst *Instance) watchdog(cmd *exec.Cmd, exited chan struct{}, startedAt time.Time) {
+	if inst.limits.Memory <= 0 && inst.limits.WallTime <= 0 {
+		return
+	}
+	interval := time.Duration(inst.config.GetInt("limits.interval")) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		reason := ""
+		if inst.limits.WallTime > 0 && time.Since(startedAt) > inst.limits.WallTime {
+			reason = fmt.Sprintf("wall time limit exceeded (%s)", inst.limits.WallTime)
+		} else if inst.limits.Memory > 0 {
+			rss, err := processMemory(cmd.Process.Pid)
+			if err == nil && rss > inst.limits.Memory {
+				reason = fmt.Sprintf("memory limit exceeded (%d MB)", rss/1024/1024)
+			}
+		}
+		if reason != "" {
+			inst.Lock()
+			inst.killReason = reason
+			inst.limitKilled = true
+			inst.Unlock()
+			inst.config.Logger().Info(inst.appName + " instance " + reason + ", restarting (" + inst.ID + ")")
+			inst.log.WriteLine("[appservR] " + reason + ", killing instance")
+			killCmd(cmd)
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+//go:build linux
+
+package appserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+	"golang.org/x/sys/unix"
+)
+
+// Script run by instance processes before executing the app, waiting for limits to be applied
+const limitsGate = `read _ <&3; exec 3<&-; exec "$@"`
+
+// Find the cgroup v2 in which instance cgroups with memory and cpu controllers can be created:
+// the cgroup set in limits.cgroupparent, or else the cgroup of the service if these controllers
+// are already enabled for its children. The service process is never moved to another cgroup
+func delegatedCgroup(conf config.Config) (string, error) {
+	parent := conf.GetString("limits.cgroupparent")
+	if parent == "" {
+		b, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return "", errors.New("cgroup v2 not available")
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(b)))
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "0::") {
+				parent = filepath.Join("/sys/fs/cgroup", strings.TrimPrefix(scanner.Text(), "0::"))
+			}
+		}
+		if parent == "" {
+			return "", errors.New("cgroup v2 not available")
+		}
+	}
+	controlFile := filepath.Join(parent, "cgroup.subtree_control")
+	controllers, err := os.ReadFile(controlFile)
+	if err != nil {
+		return "", errors.New("cgroup v2 not available")
+	}
+	if !strings.Contains(string(controllers), "memory") || !strings.Contains(string(controllers), "cpu") {
+		err = os.WriteFile(controlFile, []byte("+memory +cpu"), 0644)
+		if err != nil {
+			return "", fmt.Errorf("memory and cpu controllers cannot be enabled in cgroup %s", parent)
+		}
+	}
+	return parent, nil
+}
+
+// Start an instance process with its resource limits: the process waits for rlimits and a
+// dedicated cgroup to be applied before executing the app, so that all processes it starts
+// are subject to them; returns the path of the cgroup created, if any
+func startLimited(cmd *exec.Cmd, limits Limits, name string, conf config.Config) (string, error) {
+	if limits.OpenFiles <= 0 && limits.Memory <= 0 && limits.CPU <= 0 {
+		return "", cmd.Start()
+	}
+	gateReader, gateWriter, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer gateWriter.Close()
+	cmd.Args = append([]string{"/bin/sh", "-c", limitsGate, "sh", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	cmd.ExtraFiles = append(cmd.ExtraFiles, gateReader)
+	err = cmd.Start()
+	gateReader.Close()
+	if err != nil {
+		return "", err
+	}
+	return applyLimits(cmd.Process.Pid, limits, name, conf), nil
+}
+
+// Apply resource limits to a process: rlimits, and a dedicated cgroup when possible; returns
+// the path of the cgroup created, if any
+func applyLimits(pid int, limits Limits, name string, conf config.Config) string {
+	logger := conf.Logger()
+	if limits.OpenFiles > 0 {
+		err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, &unix.Rlimit{Cur: limits.OpenFiles, Max: limits.OpenFiles}, nil)
+		if err != nil {
+			logger.Warning("unable to limit open files of " + name + ": " + err.Error())
+		}
+	}
+	if (limits.Memory <= 0 && limits.CPU <= 0) || conf.GetString("limits.cgroups") != "true" {
+		return ""
+	}
+	parent, err := delegatedCgroup(conf)
+	if err != nil {
+		logger.Warning(err.Error() + ", memory and cpu limits of " + name + " are enforced by the watchdog only")
+		return ""
+	}
+	// each start gets its own cgroup, as the cgroup of a previous process may not be removed yet
+	// while its last processes exit; leftovers which are empty by now are removed
+	prefix := filepath.Join(parent, "appservr-"+name+"-")
+	stale, _ := filepath.Glob(prefix + "*")
+	for _, dir := range stale {
+		os.Remove(dir)
+	}
+	cgroup := prefix + strconv.Itoa(pid)
+	err = os.Mkdir(cgroup, 0755)
+	if err == nil && limits.Memory > 0 {
+		err = os.WriteFile(filepath.Join(cgroup, "memory.max"), []byte(strconv.FormatInt(limits.Memory, 10)), 0644)
+	}
+	if err == nil && limits.CPU > 0 {
+		err = os.WriteFile(filepath.Join(cgroup, "cpu.max"), []byte(fmt.Sprintf("%d 100000", limits.CPU*1000)), 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	}
+	if err != nil {
+		logger.Warning("unable to set cgroup limits of " + name + ": " + err.Error())
+		os.Remove(cgroup)
+		return ""
+	}
+	return cgroup
+}
+
+// Remove the cgroup of a stopped instance; if processes are still exiting, it is removed at the
+// next start of the instance instead
+func releaseLimits(cgroup string, conf config.Config) {
+	if cgroup == "" {
+		return
+	}
+	if err := os.Remove(cgroup); err != nil && !os.IsNotExist(err) {
+		conf.Logger().Warning("unable to remove cgroup " + cgroup + ": " + err.Error())
+	}
+}
+
+// Get the resident memory in bytes used by all processes of the session started by an instance
+func processMemory(sid int) (int64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	var rss int64
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// fields after the command name, which may contain spaces: state is field 3,
+		// session id field 6 and resident set size in pages field 24
+		stat := string(b)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 22 || fields[3] != strconv.Itoa(sid) {
+			continue
+		}
+		pages, err := strconv.ParseInt(fields[21], 10, 64)
+		if err == nil {
+			found = true
+			rss += pages * int64(os.Getpagesize())
+		}
+	}
+	if !found {
+		return 0, errors.New("process not found")
+	}
+	return rss, nil
+}
+
+// Get the cpu time used by the processes of each session, indexed by session id, which is the
+// pid of the process started for an instance
+func processCPUTimes() (map[int]time.Duration, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	ticks := map[int]int64{}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// user and system times in clock ticks are fields 14 and 15
+		stat := string(b)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 13 {
+			continue
+		}
+		sid, err := strconv.Atoi(fields[3])
+		utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+		stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+		if err == nil && err1 == nil && err2 == nil {
+			ticks[sid] += utime + stime
+		}
+	}
+	// the clock tick is 1/100 s on all supported architectures
+	times := make(map[int]time.Duration, len(ticks))
+	for sid, t := range ticks {
+		times[sid] = time.Duration(t) * 10 * time.Millisecond
+	}
+	return times, nil
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package appserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyLimitsCgroup(t *testing.T) {
+	// a fake cgroup hierarchy, where the control files are plain files
+	parent := t.TempDir()
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := newMockConfig()
+	conf.values["limits.cgroups"] = "true"
+	conf.values["limits.cgroupparent"] = parent
+	limits := Limits{Memory: 64 * 1024 * 1024}
+
+	// an empty cgroup left by a previous start, and one whose processes are still exiting
+	leftover := filepath.Join(parent, "appservr-app-1-100")
+	populated := filepath.Join(parent, "appservr-app-1-101")
+	if err := os.Mkdir(leftover, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(populated, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	first := applyLimits(100, limits, "app-1", conf)
+	if first != leftover {
+		t.Fatalf("expected the cgroup %s to be replaced, got %q", leftover, first)
+	}
+	if b, err := os.ReadFile(filepath.Join(first, "memory.max")); err != nil || string(b) != "67108864" {
+		t.Errorf("expected the memory limit to be set, got %q (%v)", b, err)
+	}
+	// the cgroup of the previous start is not removed yet when the instance restarts
+	second := applyLimits(102, limits, "app-1", conf)
+	if second == "" || second == first {
+		t.Fatalf("expected a new cgroup for each start, got %q", second)
+	}
+	if _, err := os.Stat(populated); err != nil {
+		t.Error("expected cgroups still in use to be kept")
+	}
+}
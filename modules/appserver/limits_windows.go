@@ -0,0 +1,31 @@
+//go:build windows
+
+package appserver
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Start an instance process; only the wall time limit is enforced by the watchdog on Windows,
+// as the memory usage of processes is not available
+func startLimited(cmd *exec.Cmd, limits Limits, name string, conf config.Config) (string, error) {
+	return "", cmd.Start()
+}
+
+// noop on Windows
+func releaseLimits(cgroup string, conf config.Config) {
+}
+
+// not supported on Windows
+func processMemory(pid int) (int64, error) {
+	return 0, errors.New("memory usage not available on Windows")
+}
+
+// not supported on Windows
+func processCPUTimes() (map[int]time.Duration, error) {
+	return nil, errors.New("cpu usage not available on Windows")
+}
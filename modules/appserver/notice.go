@@ -0,0 +1,85 @@
+package appserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Script added to the pages of apps, showing a banner to connected users when the server
+// is shutting down
+const noticeScript = `<script>(function(){var s=new EventSource(%s);s.onmessage=function(e){` +
+	`if(e.data!=="shutdown")return;s.close();var d=document.createElement("div");` +
+	`d.setAttribute("style","position:fixed;top:0;left:0;right:0;z-index:100000;padding:8px;text-align:center;` +
+	`background:#fff3cd;color:#856404;font-family:sans-serif");` +
+	`d.textContent="The server is restarting and this app will stop shortly. Please save your work.";` +
+	`document.body.appendChild(d);};})();</script>`
+
+// Get the address of the stream of notices for the users of an app
+func noticeEventsURL(baseURL string, appName string) string {
+	return baseURL + "/_appservr/notices?" + url.Values{"app": {appName}}.Encode()
+}
+
+// Add the notice script to a HTML page served by an instance, before the end of its body
+func injectNotice(res *http.Response, eventsURL string) error {
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Encoding") != "" ||
+		!strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	quotedURL, _ := json.Marshal(eventsURL)
+	script := []byte(fmt.Sprintf(noticeScript, quotedURL))
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		i = len(body)
+	}
+	body = append(body[:i:i], append(script, body[i:]...)...)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// Stream notices to the users of an app as server-sent events: "shutdown" is sent when the
+// server starts shutting down, so that users can save their work during the drain period
+func (s *AppServer) NoticeEvents() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app, err := s.getApp(c.Query("app"))
+		// apps which cannot be accessed are not disclosed
+		if err != nil || !app.Authorized(c) {
+			c.AbortWithStatus(404)
+			return
+		}
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+
+		// idle streams may be closed by proxies
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-s.draining:
+				c.SSEvent("message", "shutdown")
+				return false
+			case <-ticker.C:
+				c.SSEvent("message", "ping")
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package appserver
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestInjectNotice(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		header   map[string]string
+		body     string
+		injected bool
+	}{
+		{"html page", map[string]string{"Content-Type": "text/html; charset=utf-8"}, "<html><body><p>app</p></BODY></html>", true},
+		{"html fragment", map[string]string{"Content-Type": "text/html"}, "<p>app</p>", true},
+		{"compressed page", map[string]string{"Content-Type": "text/html", "Content-Encoding": "gzip"}, "<body></body>", false},
+		{"other content", map[string]string{"Content-Type": "application/json"}, "{}", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tc.body))}
+			for k, v := range tc.header {
+				res.Header.Set(k, v)
+			}
+			if err := injectNotice(res, noticeEventsURL("/base", "app")); err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if !tc.injected {
+				if string(body) != tc.body {
+					t.Errorf("expected the response to be unchanged, got %s", body)
+				}
+				return
+			}
+			i := strings.Index(string(body), `<script>`)
+			if i < 0 || !strings.Contains(string(body), `"/base/_appservr/notices?app=app"`) {
+				t.Fatalf("expected the notice script, got %s", body)
+			}
+			if end := strings.Index(strings.ToLower(string(body)), "</body>"); end >= 0 && end < i {
+				t.Errorf("expected the script before the end of the body, got %s", body)
+			}
+			if res.ContentLength != int64(len(body)) || res.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+				t.Errorf("expected the content length to be updated, got %d for %d bytes", res.ContentLength, len(body))
+			}
+		})
+	}
+}
+
+func TestNoticeEvents(t *testing.T) {
+	p := testAppProxy(config.Strategies.LEAST_USERS, "a")
+	p.App.RestrictAccess = config.AccessLevels.ALL_USERS
+	s := &AppServer{config: p.config, appsByName: map[string]*AppProxy{"app": p}, draining: make(chan struct{})}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("X-Test-User") != "" {
+			c.Set("username", c.GetHeader("X-Test-User"))
+		}
+	})
+	router.GET("/_appservr/notices", s.NoticeEvents())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(user string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+noticeEventsURL("", "app"), nil)
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := get("")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected apps not accessible to the visitor to be hidden, got %d", res.StatusCode)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Drain(0)
+	}()
+	res = get("user")
+	defer res.Body.Close()
+	scanner := bufio.NewScanner(res.Body)
+	data := ""
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data:") {
+			data = strings.TrimPrefix(scanner.Text(), "data:")
+			break
+		}
+	}
+	if data != "shutdown" {
+		t.Errorf("expected users to be notified of the shutdown, got %q", data)
+	}
+}
+
+func TestDrainRecountsUsers(t *testing.T) {
+	p := testAppProxy(config.Strategies.LEAST_USERS, "a")
+	p.config.(*MockConfig).ints["sessions.idletimeout"] = 60
+	s := &AppServer{config: p.config, appsByName: map[string]*AppProxy{"app": p}, draining: make(chan struct{})}
+	// the count was last updated while a user was connected, who has left since
+	p.Instances["a"].SetUserCount(1, false)
+
+	start := time.Now()
+	s.Drain(5 * time.Second)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("expected draining to end once users left, took %s", time.Since(start))
+	}
+	if !s.ShuttingDown() {
+		t.Error("expected the server to be shutting down")
+	}
+}
@@ -0,0 +1,101 @@
+package appserver
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Get a probe setting expressed in seconds as a duration
+func probeDuration(conf config.Config, key string) time.Duration {
+	return time.Duration(conf.GetInt(key)) * time.Second
+}
+
+// Send a HTTP request to the instance; any response which is not a server error means it is up
+func (inst *Instance) checkHTTP(client *http.Client, path string) error {
+	res, err := client.Get("http://localhost:" + inst.Port() + path)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("instance responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Poll the instance until it answers HTTP requests to mark it as running, then periodically
+// check that it is still answering and kill it otherwise so that it is restarted
+func (inst *Instance) probe(cmd *exec.Cmd, exited chan struct{}) {
+	logger := inst.config.Logger()
+	path := inst.config.GetString("probe.path")
+	client := &http.Client{Timeout: probeDuration(inst.config, "probe.timeout")}
+
+	interval := probeDuration(inst.config, "probe.readiness.interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+	deadline := time.Now().Add(probeDuration(inst.config, "probe.readiness.timeout"))
+	ticker := time.NewTicker(interval)
+	for ready := false; !ready; {
+		select {
+		case <-exited:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+		}
+		err := inst.checkHTTP(client, path)
+		if err == nil {
+			ready = true
+		} else if time.Now().After(deadline) {
+			ticker.Stop()
+			logger.Info(inst.appName + " instance did not respond before startup timeout (" + inst.ID + ")")
+			killCmd(cmd)
+			return
+		}
+	}
+	ticker.Stop()
+
+	inst.Lock()
+	if inst.cmd != cmd || inst.status != instStatus.STARTING {
+		inst.Unlock()
+		return
+	}
+	inst.status = instStatus.RUNNING
+	logger.Info("app " + inst.appName + " at " + inst.port + " is running (" + inst.ID + ")")
+	inst.Unlock()
+	if inst.onChange != nil {
+		go inst.onChange()
+	}
+
+	interval = probeDuration(inst.config, "probe.liveness.interval")
+	if interval <= 0 {
+		return
+	}
+	maxFailures := inst.config.GetInt("probe.liveness.failures")
+	failures := 0
+	ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		err := inst.checkHTTP(client, path)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= maxFailures {
+			logger.Info(inst.appName + " instance stopped responding, restarting (" + inst.ID + ")")
+			logger.Info(err.Error())
+			killCmd(cmd)
+			return
+		}
+	}
+}
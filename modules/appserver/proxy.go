@@ -2,43 +2,121 @@ package appserver
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 
+	"github.com/appservR/appservR/modules/config"
 	"github.com/gin-gonic/gin"
 )
 
-// Get the app for a specific request, based on request path and cookies, and check access right
-func (appServer *AppServer) GetApp(c *gin.Context) (*AppProxy, bool, error) {
+// Get the app for a specific request and the path prefix it is mounted at, based on request
+// host and path, and check access right
+func (appServer *AppServer) GetApp(c *gin.Context) (*AppProxy, string, bool, error) {
 	appServer.RLock()
 	defer appServer.RUnlock()
 	r := c.Request
 	reqURI, _ := url.Parse(r.RequestURI)
-	reqPath := strings.TrimSuffix(reqURI.Path, "/")
+	// apps declaring the request host are served at the root of the host
+	host := c.GetString("host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
 	for _, app := range appServer.byPath {
-		appPath := strings.TrimSuffix(app.App.Path, "/")
-		if appPath == reqPath {
-			// check user auth
-			if !app.Authorized(c) {
-				return nil, false, errors.New("unauthorized")
+		for _, h := range app.App.HostnameList() {
+			if h == host {
+				if !app.Authorized(c) {
+					return nil, "", false, errors.New("unauthorized")
+				}
+				return app, "", reqURI.Path == "/" || reqURI.Path == "", nil
 			}
-			if reqURI.Path != reqPath+"/" {
-				c.Redirect(http.StatusMovedPermanently, reqPath+"/")
-				c.Abort()
-				return nil, false, nil
+		}
+	}
+	// otherwise, the app mounted at the longest path prefixing the request path
+	for _, app := range appServer.byPath {
+		appPath := strings.TrimSuffix(app.App.Path, "/")
+		if reqURI.Path != appPath && !strings.HasPrefix(reqURI.Path, appPath+"/") {
+			continue
+		}
+		// check user auth
+		if !app.Authorized(c) {
+			return nil, "", false, errors.New("unauthorized")
+		}
+		if reqURI.Path == appPath {
+			target := config.BaseURL(appServer.config) + appPath + "/"
+			if reqURI.RawQuery != "" {
+				target += "?" + reqURI.RawQuery
 			}
-			return app, true, nil
+			c.Redirect(http.StatusMovedPermanently, target)
+			c.Abort()
+			return nil, "", false, nil
 		}
+		return app, appPath, reqURI.Path == appPath+"/", nil
+	}
+	return nil, "", false, errors.New("no matching app found")
+}
+
+// Set a cookie scoped to the path of an app, including the base URL, so that apps opened
+// in the same browser do not share their sessions
+func setAppCookie(c *gin.Context, path string, name string, value string) {
+	if path == "" {
+		path = "/"
 	}
-	appCookie, err := r.Cookie("appservr_appid")
-	if err == nil {
-		if app, ok := appServer.appsByName[appCookie.Value]; ok {
-			return app, false, nil
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   c.GetString("scheme") == "https",
+	})
+}
+
+// Find the session of a user in the cookies of a request; several session cookies are
+// sent when the paths of apps are nested
+func (p *AppProxy) sessionFromCookies(c *gin.Context, user string) string {
+	for _, cookie := range c.Request.Cookies() {
+		if cookie.Name == "appservr_session" && p.HasSession(cookie.Value, user) {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Prepare a request to be forwarded to an app: the path prefix the app is mounted at is only
+// removed from the start of the path and passed on for apps to build their URLs, along with
+// the user and the client details
+func prepareRequest(c *gin.Context, app *AppProxy, fullPrefix string, prefix string) {
+	// headers identifying the user cannot be set by clients
+	for _, h := range []string{"appservR-username", "appservR-displayedname"} {
+		c.Request.Header.Del(h)
+	}
+	if username, ok := c.Get("username"); ok {
+		c.Request.Header.Set("appservR-username", username.(string))
+	}
+	if displayedname, ok := c.Get("displayedname"); ok {
+		c.Request.Header.Set("appservR-displayedname", displayedname.(string))
+	}
+	c.Request.Header.Set("appservR-appname", app.App.Name)
+
+	if prefix != "" {
+		c.Request.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(c.Request.URL.Path, prefix), "/")
+		if c.Request.URL.RawPath != "" {
+			c.Request.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(c.Request.URL.RawPath, prefix), "/")
 		}
 	}
-	return nil, false, errors.New("no matching app found")
+	// a prefix sent by the client or a proxy would not match the path of the app
+	if fullPrefix != "" {
+		c.Request.Header.Set("X-Forwarded-Prefix", fullPrefix)
+	} else {
+		c.Request.Header.Del("X-Forwarded-Prefix")
+	}
+	// the client address is appended to X-Forwarded-For by the reverse proxy
+	c.Request.Header.Set("X-Forwarded-Proto", c.GetString("scheme"))
+	c.Request.Header.Set("X-Forwarded-Host", c.GetString("host"))
 }
 
 // Create a proxy handler
@@ -47,6 +125,13 @@ func (s *AppServer) CreateProxy() gin.HandlerFunc {
 	director := func(req *http.Request) {}
 	proxy := &httputil.ReverseProxy{Director: director}
 	logger := s.config.Logger()
+	externalProxy := &httputil.ReverseProxy{
+		Director: director,
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			logger.Debug(err.Error())
+			res.WriteHeader(http.StatusBadGateway)
+		},
+	}
 
 	abortWithError := func(c *gin.Context, err error) {
 		if err != nil {
@@ -58,7 +143,7 @@ func (s *AppServer) CreateProxy() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		// Find matching app and check auth
-		app, root, err := s.GetApp(c)
+		app, prefix, root, err := s.GetApp(c)
 		if err != nil {
 			abortWithError(c, err)
 			return
@@ -67,55 +152,99 @@ func (s *AppServer) CreateProxy() gin.HandlerFunc {
 		if app == nil {
 			return
 		}
+		baseURL := config.BaseURL(s.config)
+		// external apps are only proxied, with no session nor instance
+		if upstream := app.Upstream(); upstream != nil {
+			if !app.App.IsActive {
+				abortWithError(c, errors.New("app is not active"))
+				return
+			}
+			prepareRequest(c, app, baseURL+prefix, prefix)
+			stripCredentials(c.Request)
+			c.Request.URL.Scheme = upstream.Scheme
+			c.Request.URL.Host = upstream.Host
+			c.Request.URL.Path = strings.TrimSuffix(upstream.Path, "/") + c.Request.URL.Path
+			if c.Request.URL.RawPath != "" {
+				c.Request.URL.RawPath = strings.TrimSuffix(upstream.EscapedPath(), "/") + c.Request.URL.RawPath
+			}
+			c.Request.Host = upstream.Host
+			externalProxy.ServeHTTP(c.Writer, c.Request)
+			return
+		}
 		// Is current reqest a websocket upgrade?
 		var ws = c.Request.Header.Get("Upgrade") == "websocket"
-		// Find matching session or start new session
+		user := ""
+		if username, ok := c.Get("username"); ok {
+			user = username.(string)
+		}
+		// Find matching session or start new session: opening the app starts a new session,
+		// except with dedicated instances which users keep when reloading the page
+		sessionID := ""
+		if !root || app.App.Strategy == config.Strategies.DEDICATED {
+			sessionID = app.sessionFromCookies(c, user)
+		}
+		queued := false
+		ticket := ""
+		if sessionID == "" {
+			// no new session is started while shutting down
+			if s.ShuttingDown() {
+				c.Header("Retry-After", "10")
+				c.HTML(http.StatusServiceUnavailable, "shuttingdown.html", gin.H{"refresh": 10})
+				c.Abort()
+				return
+			}
+			// visitors wait in a queue when all instances are full
+			if queueCookie, err := c.Request.Cookie("appservr_queue"); err == nil {
+				ticket = queueCookie.Value
+			}
+			queued = !app.Admit(ticket)
+		}
 		var sess *Session
-		sessCookie, err := c.Request.Cookie("appservr_session")
-		var sessNotFound error
-		if err == nil {
-			sess, sessNotFound = app.GetSession(sessCookie.Value, ws)
+		if !queued {
+			sess, err = app.GetSession(sessionID, user)
+			queued = errors.Is(err, errSaturated)
 		}
-		if root || sessNotFound != nil {
-			sess, _ = app.GetSession("", ws)
+		if queued {
+			if ws {
+				abortWithError(c, errSaturated)
+				return
+			}
+			ticket, pos := app.Enqueue(ticket)
+			setAppCookie(c, baseURL+prefix, "appservr_queue", ticket)
+			c.Header("Retry-After", "15")
+			c.HTML(http.StatusServiceUnavailable, "queue.html", gin.H{
+				"refresh": 15, "position": pos, "eventsURL": queueEventsURL(baseURL, app.App.Name, ticket)})
+			c.Abort()
+			return
 		}
-		if sess == nil {
+		if sess != nil {
+			setAppCookie(c, baseURL+prefix, "appservr_session", sess.ID)
+		}
+		if err != nil {
+			// the app may be scaled to zero, or a dedicated instance is starting: wait for it
+			if errors.Is(err, errNoInstance) && app.App.IsActive {
+				c.Header("Retry-After", "2")
+				c.HTML(http.StatusServiceUnavailable, "appstarting.html", gin.H{"refresh": 2})
+				c.Abort()
+				return
+			}
 			abortWithError(c, err)
 			return
 		}
 		sessID := sess.ID
-		inst := sess.Instance
 		origin, _ := url.Parse("http://localhost:" + sess.Instance.Port())
 
-		if username, ok := c.Get("username"); ok {
-			c.Request.Header.Set("appservR-username", username.(string))
-		}
-		if displayedname, ok := c.Get("displayedname"); ok {
-			c.Request.Header.Set("appservR-displayedname", displayedname.(string))
-		}
-		c.Request.Header.Set("appservR-appname", app.App.Name)
-
+		prepareRequest(c, app, baseURL+prefix, prefix)
 		c.Request.URL.Scheme = "http"
 		c.Request.URL.Host = origin.Host
-		if app.App.Path != "/" {
-			c.Request.URL.Path = strings.Replace(c.Request.URL.Path, app.App.Path, "", -1)
-		}
-		cookieApp := http.Cookie{
-			Name:  "appservr_appid",
-			Value: app.App.Name,
-			Path:  "/",
-		}
-		http.SetCookie(c.Writer, &cookieApp)
-		cookieSess := http.Cookie{
-			Name:  "appservr_session",
-			Value: sessID,
-			Path:  "/",
-		}
-		http.SetCookie(c.Writer, &cookieSess)
+		notify := !ws && s.config.GetString("shutdown.notify") == "true"
 		modifyResponse := func(res *http.Response) error {
 			if res.StatusCode == 404 || res.StatusCode == 500 {
 				return errors.New("error from server")
 			}
+			if notify {
+				return injectNotice(res, noticeEventsURL(baseURL, app.App.Name))
+			}
 			return nil
 		}
 		errorHandler := func(res http.ResponseWriter, req *http.Request, err error) {
@@ -124,11 +253,15 @@ func (s *AppServer) CreateProxy() gin.HandlerFunc {
 		proxy.ModifyResponse = modifyResponse
 		proxy.ErrorHandler = errorHandler
 
+		// the session counts as a connected user while requests or websockets are open,
+		// and for a while after the last one, to account for polling transports
+		app.Connect(sess)
 		proxy.ServeHTTP(c.Writer, c.Request)
-		// In case of websocket connection, close session when socket is disconnected
-		if ws {
+		app.Disconnect(sess)
+		// In case of websocket connection, close session when socket is disconnected;
+		// dedicated instances are kept for their session until it expires
+		if ws && app.App.Strategy != config.Strategies.DEDICATED {
 			app.CloseSession(sessID)
-			inst.SetUserCount(-1, true)
 		}
 	}
 }
@@ -0,0 +1,180 @@
+package appserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/config"
+	"github.com/gin-gonic/gin"
+)
+
+type MockConfig struct {
+	folder string
+	values map[string]string
+	ints   map[string]int
+	slices map[string][]string
+	logger config.Logger
+}
+
+func (c *MockConfig) ExecutableFolder() string {
+	if c.folder == "" {
+		return "."
+	}
+	return c.folder
+}
+
+func (c *MockConfig) Logger() *config.Logger {
+	return &c.logger
+}
+
+func (c *MockConfig) GetString(key string) string {
+	return c.values[key]
+}
+
+func (c *MockConfig) GetInt(key string) int {
+	return c.ints[key]
+}
+
+func (c *MockConfig) GetStringMapString(key string) map[string]string {
+	return map[string]string{}
+}
+
+func (c *MockConfig) GetStringSlice(key string) []string {
+	return c.slices[key]
+}
+
+func newMockConfig() *MockConfig {
+	return &MockConfig{values: map[string]string{}, ints: map[string]int{}, slices: map[string][]string{},
+		logger: config.NewLogger(0)}
+}
+
+// Create a gin context for a request
+func testContext(method string, target string, host string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, target, nil)
+	c.Set("host", host)
+	c.Set("scheme", "http")
+	return c, w
+}
+
+func TestGetApp(t *testing.T) {
+	conf := newMockConfig()
+	s := &AppServer{config: conf, appsByName: map[string]*AppProxy{}}
+	for _, app := range []models.App{
+		{Name: "root", Path: "/"},
+		{Name: "app", Path: "/app"},
+		{Name: "nested", Path: "/app/nested/"},
+		{Name: "hosted", Path: "/hosted", Hostnames: "example.org"},
+	} {
+		p := &AppProxy{App: app}
+		s.appsByName[app.Name] = p
+		s.byPath = append(s.byPath, p)
+	}
+	sort.SliceStable(s.byPath, s.prefixSort)
+
+	tests := []struct {
+		target   string
+		host     string
+		app      string
+		prefix   string
+		root     bool
+		redirect string
+	}{
+		{target: "/", host: "localhost", app: "root", prefix: "", root: true},
+		{target: "/other/page", host: "localhost", app: "root", prefix: ""},
+		{target: "/app/", host: "localhost", app: "app", prefix: "/app", root: true},
+		{target: "/app/page?x=1", host: "localhost", app: "app", prefix: "/app"},
+		{target: "/application/", host: "localhost", app: "root", prefix: ""},
+		{target: "/app/nested/", host: "localhost", app: "nested", prefix: "/app/nested", root: true},
+		{target: "/app/nested/a/b", host: "localhost", app: "nested", prefix: "/app/nested"},
+		{target: "/app/nestedx/", host: "localhost", app: "app", prefix: "/app"},
+		{target: "/app/nested?x=1", host: "localhost", redirect: "/app/nested/?x=1"},
+		{target: "/app", host: "localhost", redirect: "/app/"},
+		{target: "/", host: "example.org:8080", app: "hosted", prefix: "", root: true},
+		{target: "/app/", host: "EXAMPLE.org", app: "hosted", prefix: ""},
+	}
+	for _, test := range tests {
+		c, w := testContext("GET", test.target, test.host)
+		app, prefix, root, err := s.GetApp(c)
+		if err != nil {
+			t.Errorf("%s%s: %s", test.host, test.target, err)
+			continue
+		}
+		if test.redirect != "" {
+			if app != nil || w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.redirect {
+				t.Errorf("%s%s: expected redirect to %s, got %d %s", test.host, test.target, test.redirect, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if app == nil || app.App.Name != test.app || prefix != test.prefix || root != test.root {
+			name := ""
+			if app != nil {
+				name = app.App.Name
+			}
+			t.Errorf("%s%s: expected app %s at %q (root %v), got %s at %q (root %v)",
+				test.host, test.target, test.app, test.prefix, test.root, name, prefix, root)
+		}
+	}
+
+	t.Run("base url", func(t *testing.T) {
+		conf.values["server.baseurl"] = "/base"
+		defer delete(conf.values, "server.baseurl")
+		c, w := testContext("GET", "/app", "localhost")
+		s.GetApp(c)
+		if w.Header().Get("Location") != "/base/app/" {
+			t.Errorf("expected redirect under base url, got %s", w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("no app", func(t *testing.T) {
+		delete(s.appsByName, "root")
+		s.byPath = s.byPath[:len(s.byPath)-1]
+		c, _ := testContext("GET", "/other", "localhost")
+		if app, _, _, err := s.GetApp(c); err == nil || app != nil {
+			t.Errorf("expected no matching app")
+		}
+	})
+}
+
+func TestPrepareRequest(t *testing.T) {
+	app := &AppProxy{App: models.App{Name: "app"}}
+	tests := []struct {
+		target     string
+		fullPrefix string
+		prefix     string
+		path       string
+		rawPath    string
+	}{
+		{target: "/app/page", fullPrefix: "/app", prefix: "/app", path: "/page"},
+		{target: "/app/", fullPrefix: "/app", prefix: "/app", path: "/"},
+		{target: "/app/x/app/y", fullPrefix: "/app", prefix: "/app", path: "/x/app/y"},
+		{target: "/app/a%2Fb/app", fullPrefix: "/app", prefix: "/app", path: "/a/b/app", rawPath: "/a%2Fb/app"},
+		{target: "/page/app", fullPrefix: "", prefix: "", path: "/page/app"},
+		{target: "/app/page", fullPrefix: "/base/app", prefix: "/app", path: "/page"},
+	}
+	for _, test := range tests {
+		c, _ := testContext("GET", test.target, "example.org")
+		c.Request.Header.Set("X-Forwarded-Prefix", "/spoofed")
+		c.Request.Header.Set("appservR-username", "spoofed")
+		c.Set("username", "user")
+		prepareRequest(c, app, test.fullPrefix, test.prefix)
+		r := c.Request
+		if r.URL.Path != test.path || r.URL.RawPath != test.rawPath {
+			t.Errorf("%s: expected path %s (%s), got %s (%s)", test.target, test.path, test.rawPath, r.URL.Path, r.URL.RawPath)
+		}
+		if r.Header.Get("X-Forwarded-Prefix") != test.fullPrefix {
+			t.Errorf("%s: expected prefix %q, got %q", test.target, test.fullPrefix, r.Header.Get("X-Forwarded-Prefix"))
+		}
+		if r.Header.Get("appservR-username") != "user" || r.Header.Get("appservR-appname") != "app" {
+			t.Errorf("%s: unexpected user headers", test.target)
+		}
+		if r.Header.Get("X-Forwarded-Host") != "example.org" || r.Header.Get("X-Forwarded-Proto") != "http" {
+			t.Errorf("%s: unexpected forwarded headers", test.target)
+		}
+	}
+}
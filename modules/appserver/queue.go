@@ -0,0 +1,151 @@
+package appserver
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+var errSaturated = errors.New("all instances have reached their maximum number of users")
+
+// Delay after which visitors who stopped waiting are removed from the queue
+const queueTimeout = 30 * time.Second
+
+// A visitor waiting for an instance to accept new users
+type queueEntry struct {
+	ticket   string
+	lastSeen time.Time
+}
+
+// Check whether a running instance can accept a new user
+func (p *AppProxy) hasCapacity() bool {
+	if p.dedicated() {
+		return p.canDedicate()
+	}
+	for _, inst := range p.Instances {
+		if inst.Status() == instStatus.RUNNING && !p.full(inst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether an instance has reached the maximum number of users
+func (p *AppProxy) full(inst *Instance) bool {
+	if p.dedicated() {
+		return p.sessionCount(inst) > 0
+	}
+	return p.App.MaxUsersPerWorker > 0 && inst.UserCount() >= p.App.MaxUsersPerWorker
+}
+
+// Remove visitors who stopped waiting
+func (p *AppProxy) pruneQueue() {
+	queue := p.queue[:0]
+	for _, e := range p.queue {
+		if time.Since(e.lastSeen) < queueTimeout {
+			queue = append(queue, e)
+		}
+	}
+	p.queue = queue
+}
+
+// Get the position of a ticket in the queue, starting at 1, or 0 if it is not queued
+func (p *AppProxy) queuePosition(ticket string) int {
+	for i, e := range p.queue {
+		if e.ticket == ticket {
+			e.lastSeen = time.Now()
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Check whether a visitor can start a new session: either nobody is waiting, or the visitor
+// is first in the queue and an instance has capacity, in which case they leave the queue
+func (p *AppProxy) Admit(ticket string) bool {
+	p.Lock()
+	defer p.Unlock()
+	p.pruneQueue()
+	if len(p.queue) == 0 {
+		return true
+	}
+	if p.queue[0].ticket == ticket && p.hasCapacity() {
+		p.queue = p.queue[1:]
+		return true
+	}
+	return false
+}
+
+// Add a visitor to the queue if not already waiting; returns their ticket and position
+func (p *AppProxy) Enqueue(ticket string) (string, int) {
+	p.Lock()
+	defer func() {
+		p.Unlock()
+		go p.Rescale()
+	}()
+	p.pruneQueue()
+	if pos := p.queuePosition(ticket); pos > 0 {
+		return ticket, pos
+	}
+	if ticket == "" {
+		ticket = uuid.NewV4().String()
+	}
+	p.queue = append(p.queue, &queueEntry{ticket: ticket, lastSeen: time.Now()})
+	return ticket, len(p.queue)
+}
+
+// Get the position of a visitor in the queue, or 0 if they can start their session
+func (p *AppProxy) QueuePosition(ticket string) int {
+	p.Lock()
+	defer p.Unlock()
+	p.pruneQueue()
+	pos := p.queuePosition(ticket)
+	if pos == 1 && p.hasCapacity() {
+		return 0
+	}
+	return pos
+}
+
+// Get the address of the stream of queue positions for a visitor of an app
+func queueEventsURL(baseURL string, appName string, ticket string) string {
+	return baseURL + "/_appservr/queue?" + url.Values{"app": {appName}, "ticket": {ticket}}.Encode()
+}
+
+// Stream the position of a visitor in the queue of an app as server-sent events, until
+// they can start their session
+func (s *AppServer) QueueEvents() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		app, err := s.getApp(c.Query("app"))
+		// apps which cannot be accessed are not disclosed
+		if err != nil || !app.Authorized(c) {
+			c.AbortWithStatus(404)
+			return
+		}
+		ticket := c.Query("ticket")
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		c.Stream(func(w io.Writer) bool {
+			pos := app.QueuePosition(ticket)
+			if pos == 0 {
+				c.SSEvent("message", "ready")
+				return false
+			}
+			c.SSEvent("message", strconv.Itoa(pos))
+			select {
+			case <-ticker.C:
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
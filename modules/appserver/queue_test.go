@@ -0,0 +1,131 @@
+package appserver
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestQueue(t *testing.T) {
+	p := testAppProxy(config.Strategies.LEAST_USERS, "a")
+	p.App.MaxUsersPerWorker = 1
+	p.done = make(chan struct{})
+	close(p.done) // no rescaling
+	p.Instances["a"].SetUserCount(1, false)
+
+	t.Run("order", func(t *testing.T) {
+		if !p.Admit("") {
+			t.Fatal("expected visitors to be admitted when nobody is waiting")
+		}
+		first, pos1 := p.Enqueue("")
+		second, pos2 := p.Enqueue("")
+		if pos1 != 1 || pos2 != 2 || first == second {
+			t.Fatalf("expected distinct tickets at positions 1 and 2, got %d and %d", pos1, pos2)
+		}
+		if _, pos := p.Enqueue(first); pos != 1 {
+			t.Errorf("expected a waiting visitor to keep their position, got %d", pos)
+		}
+		if p.Admit(first) || p.Admit("") {
+			t.Errorf("expected nobody to be admitted while instances are full")
+		}
+		if p.QueuePosition(first) != 1 || p.QueuePosition(second) != 2 || p.QueuePosition("unknown") != 0 {
+			t.Errorf("unexpected queue positions")
+		}
+		// an instance accepts a new user: only the first visitor in the queue gets in
+		p.Instances["a"].SetUserCount(0, false)
+		if p.QueuePosition(first) != 0 || p.QueuePosition(second) != 2 {
+			t.Errorf("expected the first visitor to be ready")
+		}
+		if p.Admit(second) || !p.Admit(first) {
+			t.Errorf("expected visitors to be admitted in order")
+		}
+		if p.QueuePosition(second) != 0 || !p.Admit(second) {
+			t.Errorf("expected the next visitor to be admitted")
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		p.Instances["a"].SetUserCount(1, false)
+		gone, _ := p.Enqueue("")
+		waiting, _ := p.Enqueue("")
+		p.queue[0].lastSeen = time.Now().Add(-queueTimeout)
+		if pos := p.QueuePosition(waiting); pos != 1 {
+			t.Errorf("expected visitors who stopped waiting to leave the queue, got position %d", pos)
+		}
+		if p.QueuePosition(gone) != 0 {
+			t.Errorf("expected the expired ticket to be removed")
+		}
+	})
+}
+
+func TestQueueEvents(t *testing.T) {
+	p := testAppProxy(config.Strategies.LEAST_USERS, "a")
+	p.App.MaxUsersPerWorker = 1
+	p.App.RestrictAccess = config.AccessLevels.ALL_USERS
+	p.done = make(chan struct{})
+	close(p.done)
+	p.Instances["a"].SetUserCount(1, false)
+	s := &AppServer{config: p.config, appsByName: map[string]*AppProxy{"app": p}}
+	first, _ := p.Enqueue("")
+	second, _ := p.Enqueue("")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("X-Test-User") != "" {
+			c.Set("username", c.GetHeader("X-Test-User"))
+		}
+	})
+	router.GET("/_appservr/queue", s.QueueEvents())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// Get the first event sent to a visitor
+	firstEvent := func(target string, user string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+target, nil)
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data:") {
+				return res.StatusCode, strings.TrimPrefix(scanner.Text(), "data:")
+			}
+		}
+		return res.StatusCode, ""
+	}
+
+	if code, _ := firstEvent(queueEventsURL("", "app", second), ""); code != http.StatusNotFound {
+		t.Errorf("expected apps not accessible to the visitor to be hidden, got %d", code)
+	}
+	if code, _ := firstEvent(queueEventsURL("", "unknown", second), "user"); code != http.StatusNotFound {
+		t.Errorf("expected unknown apps to be not found, got %d", code)
+	}
+	if _, data := firstEvent(queueEventsURL("", "app", second), "user"); data != "2" {
+		t.Errorf("expected the position in the queue, got %q", data)
+	}
+	p.Lock()
+	p.Instances["a"].SetUserCount(0, false)
+	p.Unlock()
+	if _, data := firstEvent(queueEventsURL("", "app", first), "user"); data != "ready" {
+		t.Errorf("expected the first visitor to be ready, got %q", data)
+	}
+}
+
+func TestQueueEventsURL(t *testing.T) {
+	got := queueEventsURL("/base", "my app&x=1", "t#1")
+	if got != "/base/_appservr/queue?app=my+app%26x%3D1&ticket=t%231" {
+		t.Errorf("unexpected url %s", got)
+	}
+}
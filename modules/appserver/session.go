@@ -1,23 +1,43 @@
 package appserver
 
 import (
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
 type Session struct {
+	lastActive int64 // unix time of the last request, accessed atomically (first for alignment)
+	conns      int32 // requests and websockets currently open, accessed atomically
 	ID         string
-	LastActive int64
+	User       string // authenticated user who started the session, if any
 	Instance   *Instance
 	app        *AppProxy
 }
 
-func NewSession(app *AppProxy) *Session {
+func NewSession(app *AppProxy, user string) *Session {
 	sess := &Session{
 		ID:         uuid.NewV4().String(),
-		LastActive: time.Now().Unix(),
+		User:       user,
+		lastActive: time.Now().Unix(),
 		app:        app,
 	}
 	return sess
 }
+
+// Record activity in the session
+func (sess *Session) touch() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().Unix())
+}
+
+// Get the unix time of the last activity in the session
+func (sess *Session) LastActive() int64 {
+	return atomic.LoadInt64(&sess.lastActive)
+}
+
+// Check whether a user is connected to the session: a request or websocket is open,
+// or the last request ended recently, as with polling transports
+func (sess *Session) active(idleTimeout int64) bool {
+	return atomic.LoadInt32(&sess.conns) > 0 || sess.LastActive() >= time.Now().Unix()-idleTimeout
+}
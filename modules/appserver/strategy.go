@@ -0,0 +1,166 @@
+package appserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Check that a load balancing strategy is known; an empty strategy means least users
+func CheckStrategy(strategy string) error {
+	switch strategy {
+	case "", config.Strategies.LEAST_USERS, config.Strategies.ROUND_ROBIN,
+		config.Strategies.LEAST_CPU, config.Strategies.DEDICATED:
+		return nil
+	}
+	return fmt.Errorf("unknown load balancing strategy: %s", strategy)
+}
+
+// Check whether each session of the app gets its own instance
+func (p *AppProxy) dedicated() bool {
+	return p.App.Strategy == config.Strategies.DEDICATED
+}
+
+// Count the sessions assigned to an instance
+func (p *AppProxy) sessionCount(inst *Instance) int {
+	n := 0
+	for _, sess := range p.Sessions {
+		if sess.Instance == inst {
+			n++
+		}
+	}
+	return n
+}
+
+// Check whether a new session can get a dedicated instance, either a spare running
+// instance or a new one started on demand
+func (p *AppProxy) canDedicate() bool {
+	active := 0
+	for _, inst := range p.Instances {
+		status := inst.Status()
+		if status == instStatus.RUNNING && p.sessionCount(inst) == 0 {
+			return true
+		}
+		if status != instStatus.PHASING_OUT && status != instStatus.STOPPING {
+			active++
+		}
+	}
+	_, maxWorkers := p.workersRange()
+	return p.App.IsActive && active < maxWorkers
+}
+
+// Start a new instance for a session, when the maximum number of workers is not reached;
+// returns whether an instance is starting for the session
+func (p *AppProxy) startDedicated(sess *Session) (bool, error) {
+	if !p.canDedicate() {
+		return false, nil
+	}
+	inst := NewInstance(p.App, p.AppSource.Path(), p.config)
+	inst.onChange = p.Rescale
+	if err := inst.Start(); err != nil {
+		// the instance is not kept waiting for a restart, as a new one is started on demand
+		inst.Stop()
+		return false, err
+	}
+	p.Instances[inst.ID] = inst
+	p.lastScaleUp = time.Now()
+	sess.Instance = inst
+	p.Sessions[sess.ID] = sess
+	return true, nil
+}
+
+// Choose the instance for a new session among running instances according to the app strategy
+func (p *AppProxy) pickInstance(candidates []*Instance) *Instance {
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch p.App.Strategy {
+	case config.Strategies.ROUND_ROBIN:
+		// the instance which was given a session the longest time ago, so that instances take
+		// turns even as instances are added or become full
+		best := candidates[0]
+		for _, inst := range candidates[1:] {
+			if p.picked[inst.ID] < p.picked[best.ID] || (p.picked[inst.ID] == p.picked[best.ID] && inst.ID < best.ID) {
+				best = inst
+			}
+		}
+		p.pickCount++
+		if p.picked == nil || len(p.picked) > len(p.Instances) {
+			picked := map[string]uint64{}
+			for id := range p.Instances {
+				picked[id] = p.picked[id]
+			}
+			p.picked = picked
+		}
+		p.picked[best.ID] = p.pickCount
+		return best
+	case config.Strategies.LEAST_CPU:
+		best := candidates[0]
+		bestLoad := best.CPULoad()
+		for _, inst := range candidates[1:] {
+			load := inst.CPULoad()
+			if load < bestLoad || (load == bestLoad && inst.UserCount() < best.UserCount()) {
+				best, bestLoad = inst, load
+			}
+		}
+		return best
+	default:
+		best := candidates[0]
+		for _, inst := range candidates[1:] {
+			if inst.UserCount() < best.UserCount() {
+				best = inst
+			}
+		}
+		return best
+	}
+}
+
+// Sample the cpu usage of all instances of the app, with a single pass over all processes;
+// this is done periodically without locking the app, so that choosing an instance is cheap
+func (p *AppProxy) sampleCPU() {
+	p.RLock()
+	if p.App.Strategy != config.Strategies.LEAST_CPU {
+		p.RUnlock()
+		return
+	}
+	insts := make([]*Instance, 0, len(p.Instances))
+	for _, inst := range p.Instances {
+		insts = append(insts, inst)
+	}
+	p.RUnlock()
+	times, err := processCPUTimes()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, inst := range insts {
+		inst.sampleCPU(times, now)
+	}
+}
+
+// Update the cpu usage of the instance processes, as a fraction of one core since the
+// previous sample, from the cpu times used by process sessions
+func (inst *Instance) sampleCPU(times map[int]time.Duration, now time.Time) {
+	inst.Lock()
+	defer inst.Unlock()
+	if inst.cmd == nil || inst.cmd.Process == nil {
+		return
+	}
+	cpuTime, ok := times[inst.cmd.Process.Pid]
+	if !ok {
+		return
+	}
+	if !inst.cpuSampledAt.IsZero() && cpuTime >= inst.cpuTime {
+		inst.cpuLoad = float64(cpuTime-inst.cpuTime) / float64(now.Sub(inst.cpuSampledAt))
+	}
+	inst.cpuTime = cpuTime
+	inst.cpuSampledAt = now
+}
+
+// Get the recent cpu usage of the instance processes, as a fraction of one core
+func (inst *Instance) CPULoad() float64 {
+	inst.RLock()
+	defer inst.RUnlock()
+	return inst.cpuLoad
+}
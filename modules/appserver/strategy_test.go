@@ -0,0 +1,115 @@
+package appserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/applog"
+	"github.com/appservR/appservR/modules/config"
+	"github.com/appservR/appservR/modules/ssehandler"
+)
+
+// Create an instance with no process, keeping its output in memory only
+func testInstance(id string, status string, conf config.Config) *Instance {
+	log, _ := applog.NewInstanceLog("", 0, 0, 10)
+	return &Instance{ID: id, status: status, idleSince: time.Now(), log: log, config: conf}
+}
+
+// Create an app proxy with running instances, with no process
+func testAppProxy(strategy string, ids ...string) *AppProxy {
+	conf := newMockConfig()
+	p := &AppProxy{
+		App:          models.App{Name: "app", Strategy: strategy, MaxWorkers: len(ids)},
+		Instances:    map[string]*Instance{},
+		Sessions:     map[string]*Session{},
+		StatusStream: ssehandler.NewMessageBroker(),
+		config:       conf,
+	}
+	for _, id := range ids {
+		p.Instances[id] = testInstance(id, instStatus.RUNNING, conf)
+	}
+	return p
+}
+
+func TestPickInstance(t *testing.T) {
+
+	t.Run("least users", func(t *testing.T) {
+		p := testAppProxy(config.Strategies.LEAST_USERS, "a", "b", "c")
+		p.Instances["a"].SetUserCount(2, false)
+		p.Instances["b"].SetUserCount(1, false)
+		p.Instances["c"].SetUserCount(3, false)
+		got := p.pickInstance([]*Instance{p.Instances["a"], p.Instances["b"], p.Instances["c"]})
+		if got.ID != "b" {
+			t.Errorf("expected instance with least users, got %s", got.ID)
+		}
+	})
+
+	t.Run("least cpu", func(t *testing.T) {
+		p := testAppProxy(config.Strategies.LEAST_CPU, "a", "b", "c")
+		p.Instances["a"].cpuLoad = 0.5
+		p.Instances["b"].cpuLoad = 0.1
+		p.Instances["c"].cpuLoad = 0.1
+		p.Instances["c"].SetUserCount(1, false)
+		p.Instances["b"].SetUserCount(2, false)
+		got := p.pickInstance([]*Instance{p.Instances["a"], p.Instances["b"], p.Instances["c"]})
+		if got.ID != "c" {
+			t.Errorf("expected least loaded instance with fewest users, got %s", got.ID)
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		p := testAppProxy(config.Strategies.ROUND_ROBIN, "a", "b", "c")
+		all := []*Instance{p.Instances["c"], p.Instances["a"], p.Instances["b"]}
+		got := ""
+		for i := 0; i < 4; i++ {
+			got += p.pickInstance(all).ID
+		}
+		if got != "abca" {
+			t.Errorf("expected instances in turn from the first one, got %s", got)
+		}
+		// instances which become full keep their turn when they accept sessions again
+		withoutB := []*Instance{p.Instances["a"], p.Instances["c"]}
+		got = p.pickInstance(withoutB).ID + p.pickInstance(all).ID + p.pickInstance(all).ID
+		if got != "cba" {
+			t.Errorf("expected instances to rotate evenly, got %s", got)
+		}
+		// a new instance gets the next session
+		p.Instances["d"] = &Instance{ID: "d", status: instStatus.RUNNING}
+		all = append(all, p.Instances["d"])
+		if got := p.pickInstance(all).ID; got != "d" {
+			t.Errorf("expected the new instance, got %s", got)
+		}
+		// removed instances are forgotten
+		delete(p.Instances, "a")
+		delete(p.Instances, "d")
+		p.pickInstance([]*Instance{p.Instances["b"], p.Instances["c"]})
+		if _, ok := p.picked["a"]; ok {
+			t.Errorf("expected removed instance to be forgotten")
+		}
+	})
+}
+
+func TestDedicatedRelease(t *testing.T) {
+	p := testAppProxy(config.Strategies.DEDICATED, "idle", "recent", "connected")
+	p.config.(*MockConfig).ints["scaling.cooldown"] = 300
+	p.Instances["idle"].idleSince = time.Now().Add(-10 * time.Minute)
+	p.Instances["recent"].idleSince = time.Now().Add(-time.Minute)
+	p.Instances["connected"].SetUserCount(1, false)
+	for _, id := range []string{"idle", "recent", "connected"} {
+		sess := NewSession(p, "")
+		sess.Instance = p.Instances[id]
+		p.Sessions[id] = sess
+	}
+
+	p.collectSessions()
+
+	if _, ok := p.Sessions["idle"]; ok || p.Instances["idle"].Status() != instStatus.PHASING_OUT {
+		t.Errorf("expected the instance idle for the cooldown delay to be released")
+	}
+	for _, id := range []string{"recent", "connected"} {
+		if _, ok := p.Sessions[id]; !ok || p.Instances[id].Status() != instStatus.RUNNING {
+			t.Errorf("expected the %s session to keep its instance", id)
+		}
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/appruntime"
 	"github.com/appservR/appservR/modules/config"
+	"github.com/fsnotify/fsnotify"
 )
 
 // A generic application source interface
@@ -17,17 +21,33 @@ type AppSource interface {
 	Error() error   // get the error status if any
 }
 
+// An app source which can fetch a newer version of the app
+type UpdatableSource interface {
+	Update() error                  // get the latest version of the app
+	Fetch() (string, error)         // download the latest version without switching to it
+	Revision() string               // get an identifier of the current version
+	Checkout(revision string) error // switch to a previous version
+	Prune(inUse []string) error     // delete the versions no longer used by instances, given their app folders
+}
+
 // A simple app source based on a local folder
 type AppSourceDir struct {
-	AppDir string
-	err    error
+	sync.Mutex
+	AppDir  string
+	err     error
+	watcher *fsnotify.Watcher
+	timer   *time.Timer // pending notification of changes
 }
 
 func NewAppSource(app models.App, conf config.Config, checkOnly bool) AppSource {
 	if app.AppSource == "sample-app" {
 		return NewAppSourceSampleApp(app, conf)
-	} else if app.AppSource == "directory" {
+	} else if app.AppSource == "directory" || app.AppSource == "bundle" {
 		return NewAppSourceDir(app, conf)
+	} else if app.AppSource == "git" {
+		return NewAppSourceGit(app, conf, checkOnly)
+	} else if app.AppSource == "external" {
+		return NewAppSourceExternal(app)
 	}
 	return nil
 }
@@ -41,11 +61,9 @@ func NewAppSourceDir(app models.App, conf config.Config) *AppSourceDir {
 	if err != nil {
 		return &AppSourceDir{AppDir: "", err: errors.New("app directory path does not exist")}
 	}
-	_, err_app := os.Stat(filepath.Join(path, "app.R"))
-	_, err_server := os.Stat(filepath.Join(path, "server.R"))
-	_, err_ui := os.Stat(filepath.Join(path, "ui.R"))
-	if err_app != nil && (err_server != nil || err_ui != nil) {
-		return &AppSourceDir{AppDir: "", err: errors.New("app directory does not contain app.R or server.R and ui.R files")}
+	err = appruntime.NewAppRuntime(app).Validate(path)
+	if err != nil {
+		return &AppSourceDir{AppDir: "", err: err}
 	}
 	return &AppSourceDir{AppDir: path}
 }
@@ -71,14 +89,11 @@ func NewAppSourceSampleApp(app models.App, conf config.Config) *AppSourceDir {
 	if err != nil {
 		return &AppSourceDir{AppDir: "", err: fmt.Errorf("unable to get absolute path")}
 	}
-	_, err = os.Stat(path + "/app.R")
-	if err != nil {
-		f, err := os.Create(path + "/app.R")
-		if err != nil {
-			return &AppSourceDir{AppDir: "", err: errors.New("unable to write file app.R")}
-		}
-		defer f.Close()
-		_, err = f.WriteString(sampleApp)
+	// the sample app is rewritten when the base URL of its links changed
+	source := fmt.Sprintf(sampleApp, config.BaseURL(conf))
+	current, err := os.ReadFile(path + "/app.R")
+	if err != nil || string(current) != source {
+		err = os.WriteFile(path+"/app.R", []byte(source), 0600)
 		if err != nil {
 			return &AppSourceDir{AppDir: "", err: errors.New("unable to write file app.R")}
 		}
@@ -96,7 +111,8 @@ func (s *AppSourceDir) Error() error {
 	return s.err
 }
 
-// Nothing to do for cleanup: won't delete any files
+// Stop watching files if needed but won't delete any files
 func (s *AppSourceDir) Cleanup() error {
+	s.StopWatching()
 	return nil
 }
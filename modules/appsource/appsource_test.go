@@ -0,0 +1,314 @@
+package appsource
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/config"
+)
+
+type MockConfig struct {
+	folder string
+	logger config.Logger
+	ints   map[string]int
+}
+
+func (c *MockConfig) ExecutableFolder() string {
+	return c.folder
+}
+
+func (c *MockConfig) Logger() *config.Logger {
+	return &c.logger
+}
+
+func (c *MockConfig) GetString(key string) string {
+	if key == "git" {
+		return "git"
+	}
+	return ""
+}
+
+func (c *MockConfig) GetInt(key string) int {
+	return c.ints[key]
+}
+
+func (c *MockConfig) GetStringMapString(key string) map[string]string {
+	return map[string]string{}
+}
+
+func (c *MockConfig) GetStringSlice(key string) []string {
+	return nil
+}
+
+// Commit a file to a local git repository
+func commitFile(t *testing.T, repo string, name string, content string) {
+	err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "update " + name}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(string(out))
+		}
+	}
+}
+
+// Run a git command in a local repository
+func runGit(t *testing.T, repo string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repo
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	return string(out)
+}
+
+func TestAppSourceGit(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repo := t.TempDir()
+	cmd := exec.Command("git", "init", "--initial-branch=main", repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	commitFile(t, repo, "app.R", "# first version")
+
+	conf := &MockConfig{folder: t.TempDir(), logger: config.NewLogger(0)}
+	app := models.App{
+		Name:            "git-app",
+		AppSource:       "git",
+		GitSourceUrl:    "file://" + repo,
+		GitSourceBranch: "main",
+	}
+
+	t.Run("git=check", func(t *testing.T) {
+		if err := NewAppSource(app, conf, true).Error(); err != nil {
+			t.Error(err)
+		}
+		wrongBranch := app
+		wrongBranch.GitSourceBranch = "unknown"
+		if NewAppSource(wrongBranch, conf, true).Error() == nil {
+			t.Error("unknown branch should not be valid")
+		}
+	})
+
+	t.Run("git=clone", func(t *testing.T) {
+		source := NewAppSource(app, conf, false)
+		if err := source.Error(); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(source.Path(), "app.R"))
+		if err != nil || string(content) != "# first version" {
+			t.Error("app not checked out")
+		}
+		firstRevision := source.(UpdatableSource).Revision()
+		commitFile(t, repo, "app.R", "# second version")
+		if err := source.(UpdatableSource).Update(); err != nil {
+			t.Fatal(err)
+		}
+		content, _ = os.ReadFile(filepath.Join(source.Path(), "app.R"))
+		if string(content) != "# second version" || source.(UpdatableSource).Revision() == firstRevision {
+			t.Error("app not updated")
+		}
+		// instances started before the update keep their revision until they stop
+		firstPath := filepath.Join(filepath.Dir(source.Path()), firstRevision)
+		content, _ = os.ReadFile(filepath.Join(firstPath, "app.R"))
+		if string(content) != "# first version" {
+			t.Error("previous revision not kept")
+		}
+		if err := source.(UpdatableSource).Prune([]string{firstPath}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(firstPath); err != nil {
+			t.Error("revision in use should not be deleted")
+		}
+		if err := source.(UpdatableSource).Prune(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(firstPath); err == nil {
+			t.Error("unused revision should be deleted")
+		}
+		if _, err := os.Stat(source.Path()); err != nil {
+			t.Error("current revision should not be deleted")
+		}
+		if err := source.Cleanup(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("git=pinned", func(t *testing.T) {
+		pinned := app
+		pinned.GitRevision = strings.TrimSpace(runGit(t, repo, "rev-list", "--max-parents=0", "HEAD"))
+		// the pinned revision is checked out from a new clone, and kept when restarting
+		var source AppSource
+		for i := 0; i < 2; i++ {
+			source = NewAppSource(pinned, conf, false)
+			if err := source.Error(); err != nil {
+				t.Fatal(err)
+			}
+			content, _ := os.ReadFile(filepath.Join(source.Path(), "app.R"))
+			if string(content) != "# first version" || source.(UpdatableSource).Revision() != pinned.GitRevision {
+				t.Error("pinned revision not checked out")
+			}
+		}
+		source.Cleanup()
+	})
+}
+
+// Build a zip archive in memory
+func zipFiles(t *testing.T, files map[string]string) *bytes.Reader {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestExtractBundle(t *testing.T) {
+
+	conf := &MockConfig{folder: t.TempDir(), logger: config.NewLogger(0)}
+	app := models.App{Name: "bundle-app", AppSource: "bundle"}
+
+	t.Run("bundle=extract", func(t *testing.T) {
+		archive := zipFiles(t, map[string]string{"myapp/app.R": "# app", "myapp/data/data.csv": "a,b"})
+		dir, err := ExtractBundle(app, conf, archive, archive.Size(), "myapp.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.AppDir = dir
+		source := NewAppSource(app, conf, false)
+		if source.Error() != nil {
+			t.Error(source.Error())
+		}
+		if _, err := os.Stat(filepath.Join(source.Path(), "data", "data.csv")); err != nil {
+			t.Error("bundle not extracted")
+		}
+	})
+
+	t.Run("bundle=invalid", func(t *testing.T) {
+		archive := zipFiles(t, map[string]string{"README.md": "no app here"})
+		if _, err := ExtractBundle(app, conf, archive, archive.Size(), "app.zip"); err == nil {
+			t.Error("bundle without app should be rejected")
+		}
+		archive = zipFiles(t, map[string]string{"app.R": "# app", "../outside.R": "# outside"})
+		if _, err := ExtractBundle(app, conf, archive, archive.Size(), "app.zip"); err == nil {
+			t.Error("bundle with files outside of app directory should be rejected")
+		}
+		archive = zipFiles(t, map[string]string{"app.R": "# app"})
+		for _, name := range []string{"../bundle-app", "apps/bundle-app", `apps\bundle-app`, ""} {
+			if _, err := ExtractBundle(models.App{Name: name}, conf, archive, archive.Size(), "app.zip"); err == nil {
+				t.Errorf("bundle for app name %q should be rejected", name)
+			}
+		}
+	})
+
+	t.Run("bundle=limits", func(t *testing.T) {
+		conf := &MockConfig{folder: conf.folder, logger: config.NewLogger(0), ints: map[string]int{
+			"deployments.maxsize":          1,
+			"deployments.maxextractedsize": 2,
+		}}
+		// highly compressible files, below the upload limit but above the extracted size limit
+		large := strings.Repeat("0", 1<<20)
+		archive := zipFiles(t, map[string]string{"app.R": large, "data1.csv": large, "data2.csv": large})
+		if archive.Size() > 1<<20 {
+			t.Fatal("archive should be smaller than the upload limit")
+		}
+		_, err := ExtractBundle(app, conf, archive, archive.Size(), "app.zip")
+		if err == nil || !strings.Contains(err.Error(), "extracted bundle is larger") {
+			t.Errorf("bundle larger than the extracted size limit should be rejected, got %v", err)
+		}
+		if _, err := ExtractBundle(app, conf, archive, 2<<20, "app.zip"); err == nil {
+			t.Error("bundle larger than the upload limit should be rejected")
+		}
+		archive = zipFiles(t, map[string]string{"app.R": large, "data1.csv": large[:1000]})
+		if _, err := ExtractBundle(app, conf, archive, archive.Size(), "app.zip"); err != nil {
+			t.Errorf("bundle within limits should be extracted, got %v", err)
+		}
+	})
+
+	t.Run("bundle=prune", func(t *testing.T) {
+		bundlesDir := filepath.Join(conf.folder, "apps", "bundles", app.Name)
+		for _, name := range []string{"old", "kept", "current", "new.tmp", "interrupted.tmp"} {
+			if err := os.MkdirAll(filepath.Join(bundlesDir, name), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		longAgo := time.Now().Add(-48 * time.Hour)
+		os.Chtimes(filepath.Join(bundlesDir, "interrupted.tmp"), longAgo, longAgo)
+		current := app
+		current.AppDir = filepath.Join("apps", "bundles", app.Name, "current")
+		if err := PruneBundles(current, conf, []string{filepath.Join("apps", "bundles", app.Name, "kept")}); err != nil {
+			t.Fatal(err)
+		}
+		for name, exists := range map[string]bool{"old": false, "kept": true, "current": true, "new.tmp": true, "interrupted.tmp": false} {
+			if _, err := os.Stat(filepath.Join(bundlesDir, name)); (err == nil) != exists {
+				t.Errorf("expected bundle %s to exist: %v", name, exists)
+			}
+		}
+	})
+
+	t.Run("bundle=delete", func(t *testing.T) {
+		if err := DeleteBundles(app, conf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(conf.folder, "apps", "bundles", app.Name)); !os.IsNotExist(err) {
+			t.Error("bundles of a deleted app should be deleted")
+		}
+	})
+}
+
+func TestWatchDir(t *testing.T) {
+
+	conf := &MockConfig{folder: t.TempDir(), logger: config.NewLogger(0)}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.R"), []byte("# app"), 0600)
+	source := NewAppSourceDir(models.App{AppDir: dir}, conf)
+
+	changed := make(chan bool, 1)
+	err := source.Watch(50*time.Millisecond, func() { changed <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.StopWatching()
+	os.WriteFile(filepath.Join(dir, "app.R"), []byte("# new version"), 0600)
+	os.WriteFile(filepath.Join(dir, "data.csv"), []byte("a,b"), 0600)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Error("change not detected")
+	}
+	select {
+	case <-changed:
+		t.Error("changes should be debounced")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// changes pending when watching stops are not notified
+	os.WriteFile(filepath.Join(dir, "app.R"), []byte("# last version"), 0600)
+	time.Sleep(20 * time.Millisecond)
+	source.StopWatching()
+	select {
+	case <-changed:
+		t.Error("changes should not be notified after watching stopped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
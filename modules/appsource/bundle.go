@@ -0,0 +1,230 @@
+package appsource
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Extract an uploaded .zip or .tar.gz app bundle into a new versioned directory and check that
+// it can be served; returns the bundle directory relative to the executable folder
+func ExtractBundle(app models.App, conf config.Config, archive io.ReaderAt, size int64, fileName string) (string, error) {
+	err := models.CheckAppName(app.Name)
+	if err != nil {
+		return "", err
+	}
+	if maxSize := int64(conf.GetInt("deployments.maxsize")) << 20; maxSize > 0 && size > maxSize {
+		return "", fmt.Errorf("bundle is larger than %d MB", maxSize>>20)
+	}
+	revision := time.Now().Format("20060102-150405") + "-" + uuid.NewV4().String()[0:6]
+	relDir := filepath.Join("apps", "bundles", app.Name, revision)
+	dir, err := filepath.Abs(filepath.Join(conf.ExecutableFolder(), relDir))
+	if err != nil {
+		return "", errors.New("unable to get absolute path")
+	}
+	tmpDir := dir + ".tmp"
+	err = os.MkdirAll(tmpDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("unable to create directory %s", tmpDir)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	limit := &extractLimit{max: int64(conf.GetInt("deployments.maxextractedsize")) << 20}
+	name := strings.ToLower(fileName)
+	if strings.HasSuffix(name, ".zip") {
+		err = extractZip(archive, size, tmpDir, limit)
+	} else if strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") {
+		err = extractTarGz(io.NewSectionReader(archive, 0, size), tmpDir, limit)
+	} else {
+		err = errors.New("bundle should be a .zip or .tar.gz archive")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// archives of a whole folder contain a single top level directory
+	root := tmpDir
+	entries, err := os.ReadDir(root)
+	if err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(root, entries[0].Name())
+	}
+	app.AppDir = root
+	err = NewAppSourceDir(app, conf).Error()
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(root, dir)
+	if err != nil {
+		return "", errors.New("unable to move extracted bundle")
+	}
+	return relDir, nil
+}
+
+// Delete the bundles of an app which are not listed in the bundles to keep (relative to executable folder)
+func PruneBundles(app models.App, conf config.Config, keep []string) error {
+	err := models.CheckAppName(app.Name)
+	if err != nil {
+		return err
+	}
+	keepMap := map[string]bool{filepath.Clean(app.AppDir): true}
+	for _, k := range keep {
+		keepMap[filepath.Clean(k)] = true
+	}
+	relDir := filepath.Join("apps", "bundles", app.Name)
+	entries, err := os.ReadDir(filepath.Join(conf.ExecutableFolder(), relDir))
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		bundle := filepath.Join(relDir, e.Name())
+		// bundles being extracted are skipped, unless left by an interrupted upload long ago
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < 24*time.Hour {
+				continue
+			}
+		}
+		if e.IsDir() && !keepMap[bundle] {
+			err = os.RemoveAll(filepath.Join(conf.ExecutableFolder(), bundle))
+			if err != nil {
+				return fmt.Errorf("unable to delete bundle %s", bundle)
+			}
+		}
+	}
+	return nil
+}
+
+// Delete all the bundles of an app, when the app is deleted
+func DeleteBundles(app models.App, conf config.Config) error {
+	err := models.CheckAppName(app.Name)
+	if err != nil {
+		return err
+	}
+	relDir := filepath.Join("apps", "bundles", app.Name)
+	err = os.RemoveAll(filepath.Join(conf.ExecutableFolder(), relDir))
+	if err != nil {
+		return fmt.Errorf("unable to delete bundles of app %s", app.Name)
+	}
+	return nil
+}
+
+// Get the destination of an archive entry, making sure it does not escape the target directory
+func bundleEntryPath(dir string, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if path != dir && !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid file path in bundle: %s", name)
+	}
+	return path, nil
+}
+
+// Total size of the files extracted from a bundle, and its maximum in bytes if positive
+type extractLimit struct {
+	max     int64
+	written int64
+}
+
+// Get an error if the extracted files exceed the maximum size
+func (l *extractLimit) check() error {
+	if l.max > 0 && l.written > l.max {
+		return fmt.Errorf("extracted bundle is larger than %d MB", l.max>>20)
+	}
+	return nil
+}
+
+// Write an archive entry to a file, failing if the extracted files exceed the size limit
+func writeBundleFile(path string, r io.Reader, limit *extractLimit) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if limit.max <= 0 {
+		_, err = io.Copy(f, r)
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, limit.max-limit.written+1))
+	limit.written += n
+	if err == nil {
+		err = limit.check()
+	}
+	return err
+}
+
+func extractZip(archive io.ReaderAt, size int64, dir string, limit *extractLimit) error {
+	zr, err := zip.NewReader(archive, size)
+	if err != nil {
+		return errors.New("unable to read zip archive")
+	}
+	for _, f := range zr.File {
+		path, err := bundleEntryPath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(path, 0700)
+		} else if f.Mode().IsRegular() {
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			if err != nil {
+				return err
+			}
+			err = writeBundleFile(path, rc, limit)
+			rc.Close()
+		}
+		if err != nil {
+			if limitErr := limit.check(); limitErr != nil {
+				return limitErr
+			}
+			return fmt.Errorf("unable to extract %s", f.Name)
+		}
+	}
+	return nil
+}
+
+func extractTarGz(archive io.Reader, dir string, limit *extractLimit) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return errors.New("unable to read gzip archive")
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("unable to read tar archive")
+		}
+		path, err := bundleEntryPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0700)
+		case tar.TypeReg:
+			err = writeBundleFile(path, tr, limit)
+		}
+		if err != nil {
+			if limitErr := limit.check(); limitErr != nil {
+				return limitErr
+			}
+			return fmt.Errorf("unable to extract %s", header.Name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package appsource
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/appservR/appservR/models"
+)
+
+// An app running outside of appservR, which requests are forwarded to
+type AppSourceExternal struct {
+	url *url.URL
+	err error
+}
+
+func NewAppSourceExternal(app models.App) *AppSourceExternal {
+	u, err := url.Parse(app.UpstreamUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &AppSourceExternal{err: errors.New("upstream URL must be an absolute http or https URL")}
+	}
+	return &AppSourceExternal{url: u}
+}
+
+// No local directory for an external app
+func (s *AppSourceExternal) Path() string {
+	return ""
+}
+
+// Get the URL of the upstream server
+func (s *AppSourceExternal) URL() *url.URL {
+	return s.url
+}
+
+// Get upstream URL status
+func (s *AppSourceExternal) Error() error {
+	return s.err
+}
+
+// Nothing to clean up for an external app
+func (s *AppSourceExternal) Cleanup() error {
+	return nil
+}
@@ -0,0 +1,234 @@
+package appsource
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/appservR/appservR/models"
+	"github.com/appservR/appservR/modules/appruntime"
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Folder of the repository clone where revisions are checked out
+const revisionsDir = ".revisions"
+
+// An app source cloned from a git repository into a folder managed by appservR; each
+// revision is checked out in its own worktree, so that instances running a revision are
+// not affected when the app switches to another one
+type AppSourceGit struct {
+	sync.Mutex
+	Url      string
+	Branch   string
+	token    string
+	repoDir  string // the folder where the repository is cloned, without checkout
+	subDir   string // the app folder relative to the repository root
+	app      models.App
+	conf     config.Config
+	err      error
+	revision string
+}
+
+func NewAppSourceGit(app models.App, conf config.Config, checkOnly bool) *AppSourceGit {
+	s := &AppSourceGit{
+		Url:     app.GitSourceUrl,
+		Branch:  app.GitSourceBranch,
+		token:   app.GitSourceToken,
+		repoDir: filepath.Join(conf.ExecutableFolder(), "apps", "git", app.Name),
+		subDir:  app.AppDir,
+		app:     app,
+		conf:    conf,
+	}
+	if s.Url == "" {
+		s.err = errors.New("no git repository url provided")
+		return s
+	}
+	if s.err = models.CheckAppName(app.Name); s.err != nil {
+		return s
+	}
+	if checkOnly {
+		_, err := s.git("", "ls-remote", "--exit-code", "--", s.Url, s.ref())
+		if err != nil {
+			s.err = fmt.Errorf("unable to find branch %s in git repository", s.ref())
+		}
+		return s
+	}
+	if app.GitRevision != "" {
+		s.err = s.checkoutPinned(app.GitRevision)
+	} else {
+		s.err = s.Update()
+	}
+	return s
+}
+
+// Get the branch to checkout, defaulting to the remote HEAD
+func (s *AppSourceGit) ref() string {
+	if s.Branch == "" {
+		return "HEAD"
+	}
+	return s.Branch
+}
+
+// Run a git command, authenticating with the token if any; urls and branches are passed
+// after "--" so that they cannot be read as options, and the token is passed through the
+// environment so that it does not show in the process arguments
+func (s *AppSourceGit) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command(s.conf.GetString("git"), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if s.token != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("appservr:" + s.token))
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Clone the repository if needed, then fetch and checkout the latest revision of the branch
+func (s *AppSourceGit) Update() error {
+	err := s.fetch()
+	if err != nil {
+		return err
+	}
+	return s.Checkout("FETCH_HEAD")
+}
+
+// Fetch the latest revision of the branch and get its identifier, leaving the checked out
+// revision unchanged
+func (s *AppSourceGit) Fetch() (string, error) {
+	err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	return s.git(s.repoDir, "rev-parse", "FETCH_HEAD")
+}
+
+// Clone the repository if needed, then fetch the latest revision of the branch
+func (s *AppSourceGit) fetch() error {
+	if _, err := os.Stat(filepath.Join(s.repoDir, ".git")); err != nil {
+		err = os.MkdirAll(filepath.Dir(s.repoDir), 0700)
+		if err != nil {
+			return fmt.Errorf("unable to create directory %s", filepath.Dir(s.repoDir))
+		}
+		os.RemoveAll(s.repoDir)
+		_, err = s.git("", "clone", "--no-checkout", "--", s.Url, s.repoDir)
+		if err != nil {
+			return err
+		}
+	} else if _, err := s.git(s.repoDir, "remote", "set-url", "--", "origin", s.Url); err != nil {
+		return err
+	}
+	_, err := s.git(s.repoDir, "fetch", "--", "origin", s.ref())
+	return err
+}
+
+// Checkout the revision an app was rolled back to, from the local clone if it is available
+// there, so that the app does not move to the latest revision when restarted
+func (s *AppSourceGit) checkoutPinned(revision string) error {
+	if _, err := os.Stat(filepath.Join(s.repoDir, ".git")); err == nil {
+		if _, err := s.git(s.repoDir, "cat-file", "-e", revision+"^{commit}"); err == nil {
+			return s.Checkout(revision)
+		}
+	}
+	err := s.fetch()
+	if err != nil {
+		return err
+	}
+	return s.Checkout(revision)
+}
+
+// Checkout a specific revision of the repository in its own worktree, if not already done,
+// and switch to it; instances started before keep running the previous revision
+func (s *AppSourceGit) Checkout(revision string) error {
+	rev, err := s.git(s.repoDir, "rev-parse", "--verify", "--end-of-options", revision+"^{commit}")
+	if err != nil {
+		return err
+	}
+	dir := s.revisionDir(rev)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		// leftovers of an interrupted checkout are replaced
+		os.RemoveAll(dir)
+		s.git(s.repoDir, "worktree", "prune")
+		_, err = s.git(s.repoDir, "worktree", "add", "--force", "--detach", "--", dir, rev)
+		if err != nil {
+			return err
+		}
+	}
+	err = appruntime.NewAppRuntime(s.app).Validate(filepath.Join(dir, s.subDir))
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.revision = rev
+	return nil
+}
+
+// Delete the checked out revisions other than the current one, unless instances still run
+// from them (paths of the app folders in use)
+func (s *AppSourceGit) Prune(inUse []string) error {
+	entries, err := os.ReadDir(filepath.Join(s.repoDir, revisionsDir))
+	if err != nil {
+		return nil
+	}
+	current := s.Revision()
+	pruned := false
+	for _, e := range entries {
+		dir := s.revisionDir(e.Name())
+		if !e.IsDir() || e.Name() == current {
+			continue
+		}
+		used := false
+		for _, path := range inUse {
+			if path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+				used = true
+			}
+		}
+		if !used {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("unable to delete revision %s", e.Name())
+			}
+			pruned = true
+		}
+	}
+	if pruned {
+		_, err = s.git(s.repoDir, "worktree", "prune")
+	}
+	return err
+}
+
+// Get the currently checked out revision
+func (s *AppSourceGit) Revision() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.revision
+}
+
+// Get the folder where a revision is checked out
+func (s *AppSourceGit) revisionDir(revision string) string {
+	return filepath.Join(s.repoDir, revisionsDir, revision)
+}
+
+// Get R app directory path, in the worktree of the current revision
+func (s *AppSourceGit) Path() string {
+	return filepath.Join(s.revisionDir(s.Revision()), s.subDir)
+}
+
+// Get R app source status
+func (s *AppSourceGit) Error() error {
+	return s.err
+}
+
+// Delete the cloned repository
+func (s *AppSourceGit) Cleanup() error {
+	return os.RemoveAll(s.repoDir)
+}
@@ -1,6 +1,6 @@
 package appsource
 
-// A sample Shiny app
+// A sample Shiny app, formatted with the base URL of the server for the links to its pages
 var sampleApp = `#
 # This is a Shiny web application. You can run the application by clicking
 # the 'Run App' button above.
@@ -58,12 +58,12 @@ server <- function(input, output, session) {
                 tags$h3(paste0("Welcome, ", 
                            get("HTTP_APPSERVR_DISPLAYEDNAME", envir=session$request),
                            "!"), style="margin-top:0;"),
-                tags$a("Logout", href="/auth/logout", class="btn btn-primary")
+                tags$a("Logout", href="%[1]s/auth/logout", class="btn btn-primary")
             )
         } else {
             tagList(
                 tags$h3("Welcome!", style="margin-top:0;"),
-                tags$a("Login", href="/auth/login", class="btn btn-primary")
+                tags$a("Login", href="%[1]s/auth/login", class="btn btn-primary")
             )
         }
     })
@@ -0,0 +1,114 @@
+package appsource
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// An app source which can notify changes to its files
+type WatchableSource interface {
+	Watch(debounce time.Duration, onChange func()) error // call onChange once files stopped changing for the debounce delay
+	StopWatching()
+}
+
+// Check whether a file is hidden or an editor temporary file
+func ignoredFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".swp")
+}
+
+// Add a directory and its subdirectories to the watcher
+func watchRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && ignoredFile(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// Watch changes to files in the app directory
+func (s *AppSourceDir) Watch(debounce time.Duration, onChange func()) error {
+	s.StopWatching()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watchRecursive(watcher, s.AppDir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	s.Lock()
+	s.watcher = watcher
+	s.Unlock()
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ignoredFile(event.Name) || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						watchRecursive(watcher, event.Name)
+					}
+				}
+				s.debounce(watcher, debounce, onChange)
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Delay the notification of changes until files stopped changing, unless the watcher was
+// stopped meanwhile
+func (s *AppSourceDir) debounce(watcher *fsnotify.Watcher, debounce time.Duration, onChange func()) {
+	s.Lock()
+	defer s.Unlock()
+	if s.watcher != watcher {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(debounce, func() {
+		s.Lock()
+		watching := s.watcher == watcher
+		s.Unlock()
+		if watching {
+			onChange()
+		}
+	})
+}
+
+// Stop watching changes to files in the app directory, dropping pending notifications
+func (s *AppSourceDir) StopWatching() {
+	s.Lock()
+	defer s.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+}
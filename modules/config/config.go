@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/kardianos/osext"
 	"github.com/kardianos/service"
@@ -19,6 +21,18 @@ var AccessLevels = struct {
 	SPECIFIC_GROUPS: 2,
 }
 
+var Strategies = struct {
+	LEAST_USERS string
+	ROUND_ROBIN string
+	LEAST_CPU   string
+	DEDICATED   string
+}{
+	LEAST_USERS: "least-users",
+	ROUND_ROBIN: "round-robin",
+	LEAST_CPU:   "least-cpu",
+	DEDICATED:   "dedicated",
+}
+
 type RunFlags struct {
 	Address string
 	Mode    string
@@ -28,6 +42,9 @@ type RunFlags struct {
 type Config interface {
 	ExecutableFolder() string
 	GetString(string) string
+	GetInt(string) int
+	GetStringMapString(string) map[string]string
+	GetStringSlice(string) []string
 	Logger() *Logger
 }
 
@@ -45,10 +62,31 @@ func (c *ConfigViper) GetString(key string) string {
 	return c.v.GetString(key)
 }
 
+func (c *ConfigViper) GetInt(key string) int {
+	return c.v.GetInt(key)
+}
+
+func (c *ConfigViper) GetStringMapString(key string) map[string]string {
+	return c.v.GetStringMapString(key)
+}
+
+func (c *ConfigViper) GetStringSlice(key string) []string {
+	return c.v.GetStringSlice(key)
+}
+
 func (c *ConfigViper) Logger() *Logger {
 	return &c.logger
 }
 
+// Get the path under which the server is reached, without trailing slash
+func BaseURL(c Config) string {
+	base := strings.TrimSuffix(c.GetString("server.baseurl"), "/")
+	if base != "" && !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	return base
+}
+
 func NewConfigViper(flags RunFlags) (*ConfigViper, error) {
 
 	c := &ConfigViper{
@@ -66,8 +104,26 @@ func NewConfigViper(flags RunFlags) (*ConfigViper, error) {
 	c.v.SetDefault("server.host", "localhost")
 	c.v.SetDefault("server.name", "localhost")
 
-	// find R executable
+	// path under which the server is reached when a reverse proxy in front of it serves it
+	// under a sub-path, and addresses or CIDR ranges of the proxies whose X-Forwarded-* headers
+	// are trusted
+	c.v.SetDefault("server.baseurl", "")
+	c.v.SetDefault("server.trustedproxies", []string{})
+
+	// TLS is enabled when a certificate and key files are set; certificate files are reloaded
+	// when they change. Plain HTTP requests to the redirect port, if set, are redirected to HTTPS,
+	// and HSTS is sent with the given max age in seconds. HSTS is on by default for one year as soon
+	// as TLS is enabled, so browsers keep using HTTPS for the host; set server.tls.hsts to 0 to disable it
+	c.v.SetDefault("server.tls.cert", "")
+	c.v.SetDefault("server.tls.key", "")
+	c.v.SetDefault("server.tls.minversion", "1.2")
+	c.v.SetDefault("server.tls.redirectport", "")
+	c.v.SetDefault("server.tls.hsts", 31536000)
+
+	// find R executable; on Windows, every installed version of R is also registered as
+	// an R installation which apps can select
 	RScript := "Rscript"
+	RInstallations := map[string]string{}
 	if runtime.GOOS == "windows" {
 		RPath := "C:/Program Files/R"
 		file, err := os.Open(RPath)
@@ -79,10 +135,73 @@ func NewConfigViper(flags RunFlags) (*ConfigViper, error) {
 		if err != nil {
 			return nil, err
 		}
+		sort.Strings(names)
+		for _, name := range names {
+			RInstallations[strings.ToLower(name)] = RPath + "/" + name + "/bin/Rscript.exe"
+		}
 		RScript = RPath + "/" + names[len(names)-1] + "/bin/Rscript.exe"
 	}
 
 	c.v.SetDefault("RScript", RScript)
+	c.v.SetDefault("rinstallations", RInstallations)
+	c.v.SetDefault("git", "git")
+
+	// variables of the service environment passed to app instances, in addition to the system
+	// and locale variables and R_* variables; the apps variables are set in app settings
+	c.v.SetDefault("apps.passenv", []string{})
+
+	// delay in seconds before idle instances are phased out when load decreases
+	c.v.SetDefault("scaling.cooldown", 300)
+
+	// delay in seconds after its last request before a session without open connection
+	// no longer counts as a connected user, e.g. with long-polling transports
+	c.v.SetDefault("sessions.idletimeout", 60)
+
+	// HTTP probes used to check that instances are ready and alive (durations in seconds)
+	c.v.SetDefault("probe.path", "/")
+	c.v.SetDefault("probe.timeout", 5)
+	c.v.SetDefault("probe.readiness.interval", 1)
+	c.v.SetDefault("probe.readiness.timeout", 120)
+	c.v.SetDefault("probe.liveness.interval", 30)
+	c.v.SetDefault("probe.liveness.failures", 3)
+
+	// restart of crashed instances: maximum backoff delay and uptime after which it is reset
+	// (seconds), and number of crashes in a window (minutes) after which restarts are given up
+	c.v.SetDefault("restart.maxdelay", 60)
+	c.v.SetDefault("restart.resetafter", 300)
+	c.v.SetDefault("restart.crashloop.count", 5)
+	c.v.SetDefault("restart.crashloop.window", 10)
+
+	// delay in seconds without changes before restarting watched apps
+	c.v.SetDefault("watch.debounce", 2)
+
+	// console output logs of instances (size in MB, age in days)
+	c.v.SetDefault("logs.maxsize", 10)
+	c.v.SetDefault("logs.maxfiles", 5)
+	c.v.SetDefault("logs.bufferlines", 1000)
+	c.v.SetDefault("logs.keepdays", 7)
+
+	// interval in seconds between checks of instances memory usage and lifetime, and whether
+	// memory and cpu limits are also enforced with cgroups on Linux, in a cgroup v2 delegated to
+	// appservR (by default the cgroup of the service, if its children can use these controllers)
+	c.v.SetDefault("limits.interval", 5)
+	c.v.SetDefault("limits.cgroups", true)
+	c.v.SetDefault("limits.cgroupparent", "")
+
+	// delays in seconds on shutdown, for connected users to leave and then for instances to stop,
+	// and whether a script is added to app pages to warn connected users when shutdown starts
+	c.v.SetDefault("shutdown.drain", 10)
+	c.v.SetDefault("shutdown.timeout", 10)
+	c.v.SetDefault("shutdown.notify", true)
+
+	// number of uploaded bundles kept on disk for each app, and maximum size in MB of an uploaded
+	// bundle and of the files extracted from it (no limit if 0)
+	c.v.SetDefault("deployments.keep", 5)
+	c.v.SetDefault("deployments.maxsize", 100)
+	c.v.SetDefault("deployments.maxextractedsize", 500)
+
+	// key file used to encrypt secret environment variables of apps
+	c.v.SetDefault("secrets.keyfile", c.executableFolder+"/secret.key")
 
 	c.v.SetDefault("database.type", "sqlite")
 	c.v.SetDefault("database.path", c.executableFolder+"/data.db")
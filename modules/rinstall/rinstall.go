@@ -0,0 +1,76 @@
+package rinstall
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+// Name of the installation using the global Rscript setting
+const DEFAULT = "default"
+
+// An installation of R which apps can run on
+type Installation struct {
+	Name    string
+	Path    string
+	Version string
+}
+
+var versions sync.Map
+
+var versionRegexp = regexp.MustCompile(`version ([0-9][^ ]*)`)
+
+// Get the registered R installations, starting with the default one
+func List(conf config.Config) []Installation {
+	installations := conf.GetStringMapString("rinstallations")
+	names := make([]string, 0, len(installations))
+	for name := range installations {
+		if name != DEFAULT {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	rscript := conf.GetString("RScript")
+	res := []Installation{{Name: DEFAULT, Path: rscript, Version: Version(rscript)}}
+	for _, name := range names {
+		res = append(res, Installation{Name: name, Path: installations[name], Version: Version(installations[name])})
+	}
+	return res
+}
+
+// Get the path to the Rscript executable of an installation
+func Path(conf config.Config, name string) (string, error) {
+	if name == "" || name == DEFAULT {
+		return conf.GetString("RScript"), nil
+	}
+	path, ok := conf.GetStringMapString("rinstallations")[name]
+	if !ok {
+		return "", fmt.Errorf("unknown R installation: %s", name)
+	}
+	return path, nil
+}
+
+// Get the version of R of an Rscript executable, as reported by 'Rscript --version'
+func Version(rscript string) string {
+	if v, ok := versions.Load(rscript); ok {
+		return v.(string)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version := "unknown"
+	out, err := exec.CommandContext(ctx, rscript, "--version").CombinedOutput()
+	if err == nil {
+		if m := versionRegexp.FindSubmatch(out); m != nil {
+			version = string(m[1])
+		}
+		// only successful detections are cached, so that installations fixed later are detected
+		versions.Store(rscript, version)
+	}
+	return version
+}
@@ -0,0 +1,70 @@
+package rinstall
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/appservR/appservR/modules/config"
+)
+
+type MockConfig struct {
+	rscript       string
+	installations map[string]string
+}
+
+func (c *MockConfig) ExecutableFolder() string {
+	return "."
+}
+
+func (c *MockConfig) GetString(key string) string {
+	if key == "RScript" {
+		return c.rscript
+	}
+	return ""
+}
+
+func (c *MockConfig) GetInt(key string) int {
+	return 0
+}
+
+func (c *MockConfig) GetStringMapString(key string) map[string]string {
+	return c.installations
+}
+
+func (c *MockConfig) GetStringSlice(key string) []string {
+	return nil
+}
+
+func (c *MockConfig) Logger() *config.Logger {
+	return nil
+}
+
+func TestInstallations(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as Rscript executable")
+	}
+	rscript := filepath.Join(t.TempDir(), "Rscript")
+	err := os.WriteFile(rscript, []byte("#!/bin/sh\necho 'Rscript (R) version 4.3.1 (2023-06-16)' >&2\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &MockConfig{rscript: "Rscript", installations: map[string]string{"r-4.3": rscript}}
+
+	path, err := Path(conf, "")
+	if err != nil || path != "Rscript" {
+		t.Errorf("expected default Rscript, got %s", path)
+	}
+	path, err = Path(conf, "r-4.3")
+	if err != nil || path != rscript {
+		t.Errorf("expected installation path, got %s", path)
+	}
+	if _, err = Path(conf, "r-3.6"); err == nil {
+		t.Error("should fail for unknown installation")
+	}
+	list := List(conf)
+	if len(list) != 2 || list[0].Name != DEFAULT || list[1].Version != "4.3.1" {
+		t.Errorf("unexpected installations: %v", list)
+	}
+}
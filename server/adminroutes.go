@@ -4,22 +4,35 @@ import (
 	"net/http"
 
 	"github.com/appservR/appservR/controllers"
+	"github.com/appservR/appservR/modules/config"
 	"github.com/appservR/appservR/modules/ssehandler"
 	"github.com/gin-gonic/gin"
 )
 
-func addAdminRoutes(admin *gin.RouterGroup,
+func addAdminRoutes(admin *gin.RouterGroup, conf config.Config,
 	msgBroker *ssehandler.MessageBroker, appsCtl *controllers.AppController,
 	usersCtl *controllers.UserController, groupsCtl *controllers.GroupController) *gin.RouterGroup {
 
 	admin.GET("/", func(c *gin.Context) {
-		c.Redirect(http.StatusMovedPermanently, "/admin/apps")
+		c.Redirect(http.StatusMovedPermanently, config.BaseURL(conf)+"/admin/apps")
 	})
 
 	admin.GET("/apps", appsCtl.GetApps())
 	admin.GET("/apps/:appname", appsCtl.GetApp())
 	admin.POST("/apps/:appname", appsCtl.UpdateApp())
 	admin.GET("/apps/:appname/delete", appsCtl.DeleteApp())
+	// actions changing the state of apps are only accepted as POST requests, for the session
+	// cookie not to be sent with them from other sites
+	admin.POST("/apps/:appname/redeploy", appsCtl.RedeployApp())
+	admin.POST("/apps/:appname/retry", appsCtl.RetryApp())
+	admin.POST("/apps/:appname/bundle", appsCtl.UploadBundle())
+	admin.POST("/apps/:appname/rollback/:deployment", appsCtl.RollbackApp())
+	admin.POST("/apps/:appname/restart", appsCtl.RestartApp())
+	admin.GET("/apps/:appname/instances", appsCtl.GetInstances())
+	admin.GET("/apps/:appname/instances/:instid/logs", appsCtl.TailInstanceLog())
+	admin.POST("/apps/:appname/instances/:instid/restart", appsCtl.InstanceAction("restart", "Instance is being replaced."))
+	admin.POST("/apps/:appname/instances/:instid/phaseout", appsCtl.InstanceAction("phaseout", "Instance is phasing out."))
+	admin.POST("/apps/:appname/instances/:instid/kill", appsCtl.InstanceAction("kill", "Instance has been stopped."))
 
 	admin.GET("/apps.json", msgBroker.Controller())
 
@@ -5,19 +5,19 @@ import (
 	"net/url"
 
 	"github.com/appservR/appservR/controllers"
+	"github.com/appservR/appservR/modules/config"
 	"github.com/gin-gonic/gin"
 )
 
-func addAuthRoutes(auth *gin.RouterGroup, authCtl *controllers.AuthController) *gin.RouterGroup {
+func addAuthRoutes(auth *gin.RouterGroup, authCtl *controllers.AuthController, conf config.Config) *gin.RouterGroup {
 	auth.GET("/login", func(c *gin.Context) {
+		// the referer path already includes the base URL
 		refs := c.Request.Header["Referer"]
-		ref := "/"
+		ref := config.BaseURL(conf) + "/"
 		if len(refs) > 0 {
-			ref = refs[0]
-		}
-		if ref != "/" {
-			url, _ := url.Parse(ref)
-			ref = url.Path
+			if url, err := url.Parse(refs[0]); err == nil && url.Path != "" {
+				ref = url.Path
+			}
 		}
 		c.HTML(http.StatusOK, "login.html", gin.H{"Referer": ref})
 	})
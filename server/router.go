@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/appservR/appservR/controllers"
 	"github.com/appservR/appservR/middlewares"
@@ -16,8 +23,14 @@ import (
 )
 
 type AppRouter struct {
-	router *gin.Engine
-	config config.Config
+	sync.Mutex
+	router     *gin.Engine
+	config     config.Config
+	appServer  *appserver.AppServer
+	tlsConfig  *tls.Config
+	httpServer *http.Server
+	redirect   *http.Server // plain HTTP server redirecting to HTTPS
+	cancel     context.CancelFunc
 }
 
 // Create the router instance
@@ -32,9 +45,13 @@ func NewAppRouter(config config.Config, staticPaths *vfsdata.StaticPaths,
 	}
 
 	router := gin.New()
+	err := router.SetTrustedProxies(config.GetStringSlice("server.trustedproxies"))
+	if err != nil {
+		return nil, err
+	}
 
-	t := template.New("")
-	t, err := loadTemplate(t, "/", staticPaths)
+	t := template.New("").Funcs(templateFuncs(config))
+	t, err = loadTemplate(t, "/", staticPaths)
 	if err != nil {
 		panic(err)
 	}
@@ -45,27 +62,147 @@ func NewAppRouter(config config.Config, staticPaths *vfsdata.StaticPaths,
 		router.Use(gin.Logger())
 	}
 
+	tlsConf, err := tlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil && config.GetInt("server.tls.hsts") > 0 {
+		router.Use(hsts(config.GetInt("server.tls.hsts")))
+	}
+
 	router.StaticFS("/assets", staticPaths.Assets)
 
+	router.Use(middlewares.Forwarded())
 	router.Use(middlewares.Auth())
 
 	auth := router.Group("/auth")
-	auth = addAuthRoutes(auth, authCtl)
+	auth = addAuthRoutes(auth, authCtl, config)
 
 	admin := router.Group("/admin")
 	admin.Use(middlewares.AdminAuth())
-	admin = addAdminRoutes(admin, msgBroker, appsCtl, usersCtl, groupsCtl)
+	admin = addAdminRoutes(admin, config, msgBroker, appsCtl, usersCtl, groupsCtl)
+
+	// registered before the proxy middleware, which would otherwise handle it
+	router.GET("/_appservr/queue", appServer.QueueEvents())
+	router.GET("/_appservr/notices", appServer.NoticeEvents())
 
 	router.Use(appServer.CreateProxy())
 
-	server := &AppRouter{router: router, config: config}
+	server := &AppRouter{router: router, config: config, appServer: appServer, tlsConfig: tlsConf}
 
 	return server, nil
 }
 
+// Start serving requests until the server is shut down, over TLS if a certificate is set
 func (s *AppRouter) Start() error {
-	s.config.Logger().Warning(fmt.Sprintf("Starting server on %s:%s", s.config.GetString("server.host"), s.config.GetString("server.port")))
-	return s.router.Run(fmt.Sprintf("%s:%s", s.config.GetString("server.host"), s.config.GetString("server.port")))
+	logger := s.config.Logger()
+	host := s.config.GetString("server.host")
+	port := s.config.GetString("server.port")
+	scheme := "http"
+	if s.tlsConfig != nil {
+		scheme = "https"
+	}
+	logger.Warning(fmt.Sprintf("Starting server on %s://%s:%s", scheme, host, port))
+	if s.tlsConfig != nil && s.config.GetInt("server.tls.hsts") > 0 {
+		logger.Info(fmt.Sprintf("HSTS enabled with a max age of %d seconds", s.config.GetInt("server.tls.hsts")))
+	}
+	// the base context is canceled on shutdown to end long running requests such as event streams
+	ctx, cancel := context.WithCancel(context.Background())
+	httpServer := &http.Server{
+		Addr:        fmt.Sprintf("%s:%s", host, port),
+		Handler:     withBaseURL(config.BaseURL(s.config), s.router),
+		TLSConfig:   s.tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	var redirect *http.Server
+	if s.tlsConfig != nil && s.config.GetString("server.tls.redirectport") != "" {
+		redirect = redirectServer(fmt.Sprintf("%s:%s", host, s.config.GetString("server.tls.redirectport")), port)
+	}
+	s.Lock()
+	s.httpServer = httpServer
+	s.redirect = redirect
+	s.cancel = cancel
+	s.Unlock()
+	if redirect != nil {
+		go func() {
+			err := redirect.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("unable to start HTTP redirect server: " + err.Error())
+			}
+		}()
+	}
+	var err error
+	if s.tlsConfig != nil {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Let connected users finish their sessions during the drain period while still serving
+// requests, then stop accepting connections and stop all app instances
+func (s *AppRouter) Shutdown() error {
+	logger := s.config.Logger()
+	logger.Warning("Shutting down server")
+	drain := time.Duration(s.config.GetInt("shutdown.drain")) * time.Second
+	timeout := time.Duration(s.config.GetInt("shutdown.timeout")) * time.Second
+	s.Lock()
+	httpServer := s.httpServer
+	redirect := s.redirect
+	cancel := s.cancel
+	s.Unlock()
+	// users can still reconnect and are shown that the server is shutting down
+	s.appServer.Drain(drain)
+	if redirect != nil {
+		redirect.Close()
+	}
+	done := make(chan error, 1)
+	if httpServer != nil {
+		cancel()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			done <- httpServer.Shutdown(ctx)
+		}()
+	} else {
+		done <- nil
+	}
+	s.appServer.Shutdown(timeout)
+	err := <-done
+	logger.Warning("Server stopped")
+	return err
+}
+
+// Get the functions available in templates: links are prefixed with the base URL
+func templateFuncs(conf config.Config) template.FuncMap {
+	baseURL := config.BaseURL(conf)
+	return template.FuncMap{"base": func() string { return baseURL }}
+}
+
+// Serve requests under the base URL: the base URL is removed from request paths, which are
+// also accepted without it in case the reverse proxy in front of the server already strips it
+func withBaseURL(base string, h http.Handler) http.Handler {
+	if base == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, base+"/") {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = strings.TrimPrefix(r.URL.Path, base)
+			r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, base)
+			r2.RequestURI = r2.URL.RequestURI()
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 // Load templates recursively using the embeded files if no equivalent file exist in the local directory
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithBaseURL(t *testing.T) {
+	var path, rawPath, requestURI string
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		path = r.URL.Path
+		rawPath = r.URL.RawPath
+		requestURI = r.RequestURI
+	})
+
+	tests := []struct {
+		base       string
+		target     string
+		location   string
+		path       string
+		rawPath    string
+		requestURI string
+	}{
+		{base: "/base", target: "/base", location: "/base/"},
+		{base: "/base", target: "/base/", path: "/", requestURI: "/"},
+		{base: "/base", target: "/base/app/?x=1", path: "/app/", requestURI: "/app/?x=1"},
+		{base: "/base", target: "/base/a%2Fb", path: "/a/b", rawPath: "/a%2Fb", requestURI: "/a%2Fb"},
+		{base: "/base", target: "/baseball", path: "/baseball", requestURI: "/baseball"},
+		{base: "/base", target: "/other", path: "/other", requestURI: "/other"},
+		{base: "", target: "/base/app", path: "/base/app", requestURI: "/base/app"},
+	}
+	for _, test := range tests {
+		called = false
+		w := httptest.NewRecorder()
+		withBaseURL(test.base, h).ServeHTTP(w, httptest.NewRequest("GET", test.target, nil))
+		if test.location != "" {
+			if called || w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.location {
+				t.Errorf("%s: expected redirect to %s, got %d %s", test.target, test.location, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if !called {
+			t.Errorf("%s: expected request to be served, got %d", test.target, w.Code)
+			continue
+		}
+		if path != test.path || rawPath != test.rawPath || requestURI != test.requestURI {
+			t.Errorf("%s: expected %s %s %s, got %s %s %s", test.target, test.path, test.rawPath, test.requestURI, path, rawPath, requestURI)
+		}
+	}
+}
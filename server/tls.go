@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Delay between checks of certificate files for changes
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// A certificate loaded from files, reloaded when they change on disk
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+	logger    *config.Logger
+}
+
+// Load a certificate and its private key from files
+func newCertReloader(certFile string, keyFile string, logger *config.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get the last modification time of the certificate or key file
+func (r *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return modTime, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// Load the certificate files
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// Get the certificate for a TLS handshake, reloading it first if the files changed;
+// the previous certificate is kept if the new files cannot be loaded
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+	modTime, err := r.lastModified()
+	if err == nil && !modTime.Equal(r.modTime) {
+		err = r.load()
+		if err == nil {
+			r.logger.Warning("TLS certificate reloaded")
+		}
+	}
+	if err != nil {
+		r.logger.Error("unable to reload TLS certificate: " + err.Error())
+	}
+	return r.cert, nil
+}
+
+// Build the TLS configuration from the server.tls settings, or nil if no certificate is set
+func tlsConfig(conf config.Config) (*tls.Config, error) {
+	certFile := conf.GetString("server.tls.cert")
+	keyFile := conf.GetString("server.tls.key")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both server.tls.cert and server.tls.key must be set")
+	}
+	minVersion, ok := tlsVersions[conf.GetString("server.tls.minversion")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version: %s", conf.GetString("server.tls.minversion"))
+	}
+	reloader, err := newCertReloader(certFile, keyFile, conf.Logger())
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %s", err)
+	}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// Add the Strict-Transport-Security header to responses sent over TLS
+func hsts(maxAge int) gin.HandlerFunc {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", value)
+		}
+	}
+}
+
+// Create a server redirecting plain HTTP requests to the HTTPS port
+func redirectServer(addr string, httpsPort string) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}
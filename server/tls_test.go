@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appservR/appservR/modules/config"
+	"github.com/gin-gonic/gin"
+)
+
+type MockConfig struct {
+	values map[string]string
+	ints   map[string]int
+	slices map[string][]string
+	logger config.Logger
+}
+
+func (c *MockConfig) ExecutableFolder() string {
+	return "."
+}
+
+func (c *MockConfig) Logger() *config.Logger {
+	return &c.logger
+}
+
+func (c *MockConfig) GetString(key string) string {
+	return c.values[key]
+}
+
+func (c *MockConfig) GetInt(key string) int {
+	return c.ints[key]
+}
+
+func (c *MockConfig) GetStringMapString(key string) map[string]string {
+	return map[string]string{}
+}
+
+func (c *MockConfig) GetStringSlice(key string) []string {
+	return c.slices[key]
+}
+
+func newMockConfig() *MockConfig {
+	return &MockConfig{values: map[string]string{}, ints: map[string]int{}, slices: map[string][]string{},
+		logger: config.NewLogger(4)}
+}
+
+// Write a self-signed certificate for a host name and its key, with a given modification time
+func writeCert(t *testing.T, certFile string, keyFile string, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Get the host name of the certificate served by a reloader
+func certName(t *testing.T, r *certReloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatal("no certificate served")
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+	logger := config.NewLogger(4)
+	r, err := newCertReloader(certFile, keyFile, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		if name := certName(t, r); name != "first" {
+			t.Errorf("expected first certificate, got %s", name)
+		}
+	})
+
+	t.Run("check interval", func(t *testing.T) {
+		writeCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+		if name := certName(t, r); name != "first" {
+			t.Errorf("expected files not to be checked before the interval, got %s", name)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		r.checkedAt = time.Now().Add(-certCheckInterval)
+		if name := certName(t, r); name != "second" {
+			t.Errorf("expected certificate to be reloaded, got %s", name)
+		}
+	})
+
+	t.Run("failed reload", func(t *testing.T) {
+		os.WriteFile(certFile, []byte("invalid"), 0600)
+		modTime := start.Add(2 * time.Minute)
+		os.Chtimes(certFile, modTime, modTime)
+		r.checkedAt = time.Now().Add(-certCheckInterval)
+		if name := certName(t, r); name != "second" {
+			t.Errorf("expected previous certificate to be kept, got %s", name)
+		}
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		if _, err := newCertReloader(filepath.Join(dir, "none.pem"), keyFile, &logger); err == nil {
+			t.Errorf("expected an error for missing certificate files")
+		}
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "localhost", time.Now())
+	conf := newMockConfig()
+
+	if c, err := tlsConfig(conf); c != nil || err != nil {
+		t.Errorf("expected TLS to be disabled with no certificate")
+	}
+	conf.values["server.tls.cert"] = certFile
+	if _, err := tlsConfig(conf); err == nil {
+		t.Errorf("expected an error with a certificate and no key")
+	}
+	conf.values["server.tls.key"] = keyFile
+	conf.values["server.tls.minversion"] = "2.0"
+	if _, err := tlsConfig(conf); err == nil {
+		t.Errorf("expected an error with an unknown TLS version")
+	}
+	conf.values["server.tls.minversion"] = "1.3"
+	c, err := tlsConfig(conf)
+	if err != nil || c.MinVersion != tls.VersionTLS13 || c.GetCertificate == nil {
+		t.Errorf("unexpected TLS configuration: %v", err)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(hsts(3600))
+	router.GET("/", func(c *gin.Context) {})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	router.ServeHTTP(w, req)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("expected HSTS header over TLS, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no HSTS header over plain HTTP, got %q", got)
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	tests := []struct {
+		httpsPort string
+		host      string
+		target    string
+		location  string
+	}{
+		{httpsPort: "8443", host: "example.org:8080", target: "/app/?x=1", location: "https://example.org:8443/app/?x=1"},
+		{httpsPort: "443", host: "example.org:80", target: "/", location: "https://example.org/"},
+		{httpsPort: "443", host: "example.org", target: "/a%2Fb", location: "https://example.org/a%2Fb"},
+		{httpsPort: "8443", host: "[::1]:8080", target: "/", location: "https://[::1]:8443/"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Host = test.host
+		redirectServer(":0", test.httpsPort).Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.location {
+			t.Errorf("%s%s: expected redirect to %s, got %d %s", test.host, test.target, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -18,6 +18,7 @@ func InitializeServer(flags config.RunFlags) (*server.AppRouter, error) {
 		ssehandler.NewMessageBroker, appserver.NewAppServer,
 		config.NewConfigViper, wire.Bind(new(config.Config), new(*config.ConfigViper)),
 		models.NewAppModelDB, wire.Bind(new(models.AppModel), new(*models.AppModelDB)),
+		models.NewDeploymentModelDB, wire.Bind(new(models.DeploymentModel), new(*models.DeploymentModelDB)),
 		models.NewUserModelDB, wire.Bind(new(models.UserModel), new(*models.UserModelDB)),
 		models.NewGroupModelDB, wire.Bind(new(models.GroupModel), new(*models.GroupModelDB)),
 		controllers.NewAppController, controllers.NewUserController, controllers.NewGroupController,
@@ -29,7 +29,7 @@ func InitializeServer(flags config.RunFlags) (*server.AppRouter, error) {
 		return nil, err
 	}
 	groupModelDB := models.NewGroupModelDB(db)
-	appModelDB, err := models.NewAppModelDB(db, groupModelDB)
+	appModelDB, err := models.NewAppModelDB(db, groupModelDB, configViper)
 	if err != nil {
 		return nil, err
 	}
@@ -38,11 +38,12 @@ func InitializeServer(flags config.RunFlags) (*server.AppRouter, error) {
 	if err != nil {
 		return nil, err
 	}
-	appController := controllers.NewAppController(appModelDB, appServer, configViper)
+	deploymentModelDB := models.NewDeploymentModelDB(db)
+	appController := controllers.NewAppController(appModelDB, deploymentModelDB, appServer, configViper)
 	userModelDB := models.NewUserModelDB(db, groupModelDB)
 	userController := controllers.NewUserController(userModelDB)
 	groupController := controllers.NewGroupController(groupModelDB)
-	authController := controllers.NewAuthController(userModelDB)
+	authController := controllers.NewAuthController(userModelDB, configViper)
 	appRouter, err := server.NewAppRouter(configViper, staticPaths, appServer, messageBroker, appController, userController, groupController, authController)
 	if err != nil {
 		return nil, err